@@ -22,16 +22,71 @@ var (
 	buildDate = "unknown"
 )
 
+// commands are the subcommands accepted before the flags; without one,
+// flicksqueeze converts the library.
+var commands = map[string]bool{
+	"plan":       true,
+	"show":       true,
+	"review":     true,
+	"approve":    true,
+	"reject":     true,
+	"compare":    true,
+	"audit":      true,
+	"duplicates": true,
+	"index":      true,
+}
+
+// indexActions are the words accepted after the index command.
+var indexActions = map[string]bool{
+	"verify": true, "compact": true, "export": true, "rebuild": true,
+}
+
+// stateCommands only read state and move files. cfg.RootPath is the path
+// given on the command line.
+var stateCommands = map[string]func(flsq.Config) error{
+	"show":          func(cfg flsq.Config) error { return flsq.Show(cfg.FS, cfg.RootPath, os.Stdout) },
+	"review":        func(cfg flsq.Config) error { return flsq.Reviews(cfg, os.Stdout) },
+	"approve":       func(cfg flsq.Config) error { return flsq.Approve(cfg, cfg.RootPath) },
+	"reject":        func(cfg flsq.Config) error { return flsq.Reject(cfg, cfg.RootPath) },
+	"duplicates":    func(cfg flsq.Config) error { return flsq.Duplicates(cfg, os.Stdout, os.Stdin) },
+	"index verify":  func(cfg flsq.Config) error { return flsq.VerifyIndex(cfg, os.Stdout) },
+	"index compact": func(cfg flsq.Config) error { return flsq.CompactIndex(cfg, os.Stdout) },
+	"index export":  func(cfg flsq.Config) error { return flsq.ExportIndex(cfg, os.Stdout) },
+}
+
+// fileCommands take a movie file rather than the library folder; the file
+// may be an original that has since been retired.
+var fileCommands = map[string]bool{
+	"show": true, "approve": true, "reject": true, "compare": true,
+}
+
 func main() {
-	var cfg flsq.Config
+	cfg := flsq.Config{Version: version}
 
 	args := os.Args[1:]
+	cmd := ""
+	if len(args) > 0 && commands[args[0]] {
+		cmd, args = args[0], args[1:]
+		if cmd == "index" {
+			if len(args) == 0 || !indexActions[args[0]] {
+				fmt.Fprintln(os.Stderr, "index: want verify, compact, export or rebuild")
+				os.Exit(1)
+			}
+			cmd, args = cmd+" "+args[0], args[1:]
+		}
+	}
 	for len(args) > 0 && strings.HasPrefix(args[0], "-") {
 		switch args[0] {
 		case "--no-delete":
 			cfg.NoDelete = true
 		case "--verbose":
 			cfg.Verbose = true
+		case "--wipe":
+			cfg.Wipe = true
+		case "--remove":
+			cfg.Remove = true
+		case "--json":
+			cfg.JSON = true
 		case "--version", "-v":
 			fmt.Printf("flicksqueeze %s (commit %s, built %s)\n", version, commit, buildDate)
 			return
@@ -46,6 +101,7 @@ func main() {
 		return
 	}
 
+	cfg.Paths = args[1:]
 	rawPath := strings.TrimSpace(args[0])
 	rawPath = strings.Trim(rawPath, `"'`)
 	// Don't run filepath.Clean on ssh:// URLs: on Windows it turns / into \, breaking the URL.
@@ -64,13 +120,21 @@ func main() {
 		cfg.RootPath = remotePath
 	} else {
 		info, err := os.Stat(rawPath)
-		if err != nil || !info.IsDir() {
+		if !fileCommands[cmd] && (err != nil || !info.IsDir()) {
 			log.Fatalf("path %q is not an accessible directory", rawPath)
 		}
 		cfg.FS = vfs.Local{}
 		cfg.RootPath = rawPath
 	}
 
+	// These only read state and move files, so they need no ffmpeg.
+	if run, ok := stateCommands[cmd]; ok {
+		if err := run(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if err := ensureFFmpegInPath(); err != nil {
 		log.Fatal(err)
 	}
@@ -82,6 +146,29 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), sigs...)
 	defer cancel()
 
+	switch cmd {
+	case "plan":
+		if err := flsq.Plan(ctx, cfg, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "compare":
+		if err := flsq.Compare(ctx, cfg, cfg.RootPath, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "audit":
+		if err := flsq.Audit(ctx, cfg, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case "index rebuild":
+		if err := flsq.RebuildIndex(ctx, cfg, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if err := flsq.Run(ctx, cfg); err != nil {
 		log.Fatal(err)
 	}
@@ -105,28 +192,55 @@ func printHelp() {
 
 	fmt.Println("USAGE")
 	fmt.Println("  flicksqueeze [flags] <movie-folder | ssh://user@host/path>")
+	fmt.Println("  flicksqueeze <command> [flags] <movie-folder | ssh://user@host/path>")
+	fmt.Println()
+	fmt.Println("COMMANDS")
+	fmt.Println("  plan          Scan and list candidates in conversion order, with their scores")
+	fmt.Println("  show <file>   Print how a converted movie was made and validated")
+	fmt.Println("  review        List conversions awaiting review (review = true)")
+	fmt.Println("  approve       Replace the original <file> with its reviewed output")
+	fmt.Println("  reject        Discard the reviewed output of <file>, keep the original")
+	fmt.Println("  compare       Contact sheet and clip of <file> next to its original")
+	fmt.Println("  audit         Re-verify every converted file (marker, size, sha256, full decode)")
+	fmt.Println("  duplicates    Group probable duplicate movies and show the space they take")
+	fmt.Println("  index verify  Check this host's index for unreadable, repeated or out-of-order lines")
+	fmt.Println("  index compact Drop index entries of files that no longer exist")
+	fmt.Println("  index export  Print the index as CSV (--json: JSON lines)")
+	fmt.Println("  index rebuild Probe <path>... (files or folders in the library) again")
 	fmt.Println()
 	fmt.Println("FLAGS")
 	fmt.Println("  --no-delete   Keep originals (renamed with _deleteMe suffix)")
 	fmt.Println("  --verbose     Log why each file is skipped during scan")
+	fmt.Println("  --wipe        compare: wipe from original to output instead of side by side")
+	fmt.Println("  --remove      duplicates: ask about deleting each lesser copy")
+	fmt.Println("  --json        index export: JSON lines instead of CSV")
 	fmt.Println("  --version     Print version and exit")
 	fmt.Println()
 	fmt.Println("EXAMPLES")
 	fmt.Println("  flicksqueeze /path/to/movies")
 	fmt.Println("  flicksqueeze --no-delete /path/to/movies")
+	fmt.Println("  flicksqueeze plan /path/to/movies")
+	fmt.Println("  flicksqueeze show /path/to/movies/Film.mkv")
+	fmt.Println("  flicksqueeze index rebuild /path/to/movies Kids Film.mkv")
 	fmt.Println("  flicksqueeze ssh://username@homeserver/home/username/movies")
 	fmt.Println()
 	fmt.Println("INTERACTIVE")
 	fmt.Println("  [Enter]       Show status while running")
 	fmt.Println("  [q + Enter]   Quit after current encode finishes")
+	fmt.Println("  [r + Enter]   List conversions awaiting review (a N / x N: approve / reject)")
+	fmt.Println("  [p <path>]    Pin a file or folder to convert first (p: list, u <path>: unpin)")
 	fmt.Println("  [Ctrl+C]      Abort immediately")
 	fmt.Println()
 
 	fmt.Println("FILES (written inside <movie-folder>)")
-	fmt.Println("  .flicksqueeze-<host>.idx       Codec cache (avoids re-probing files)")
-	fmt.Println("  .flicksqueeze.failures         Paths that failed to encode")
+	fmt.Println("  .flicksqueeze-<host>.idx       Codec and preflight cache (+ .journal of recent predictions)")
+	fmt.Println("  .flicksqueeze.failures         Paths that failed to encode, with the reason")
 	fmt.Println("  .flicksqueeze.log              Tally of completed conversions")
+	fmt.Println("  .flicksqueeze.conf             Optional library settings (key = value)")
+	fmt.Println("  .flicksqueeze/                 State: conversions.jsonl, audit.tsv, review/, compare/")
 	fmt.Println("  <movie>.flsq-lock              Per-file lock while encoding")
+	fmt.Println("  <movie>.flsq-segments          Finished AV1 segments (resume after interruption)")
+	fmt.Println("  <movie>.flsq-orig.<ext>        Original kept between HEVC pre-pass and AV1")
 	fmt.Println("  <movie>.mkv                    Transcoded output (or <movie>.av1tmp.mkv)")
 	fmt.Println("  <movie>_deleteMe.<ext>         Original after conversion (--no-delete)")
 	fmt.Println()
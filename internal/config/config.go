@@ -0,0 +1,317 @@
+// Package config loads per-library settings from .flicksqueeze.conf in the
+// movie folder root. Every setting has a compiled-in default, so the file is
+// optional.
+//
+// The file holds one "key = value" per line; blank lines and lines starting
+// with # are ignored.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+// AV1 rate-control modes.
+const (
+	ModeCRF    = "crf"    // constant quality
+	ModeVBR    = "vbr"    // target a fraction of the source video bitrate
+	ModeHybrid = "hybrid" // constant quality, capped at a fraction of the source bitrate
+
+	// ModeHW marks hardware HEVC pre-pass encodes in the tally.
+	ModeHW = "hw"
+)
+
+type Library struct {
+	// EarlyAbort stops an encode once its projected output size is not
+	// smaller than the input.
+	EarlyAbort bool
+
+	// AV1Mode selects rate control; BitrateFraction is the share of the
+	// source video bitrate used as VBR target or hybrid cap.
+	AV1Mode         string
+	BitrateFraction float64
+
+	// HEVCArchive, when set, is where originals are kept between the HEVC
+	// pre-pass and the AV1 stage (mirroring their path under the library
+	// root) instead of next to the HEVC file. Load resolves a relative
+	// folder against the library root.
+	HEVCArchive string
+
+	// Preflight encodes short samples before a full AV1 encode to predict
+	// its savings, and skips files predicted to save less than
+	// PreflightMinSavings.
+	Preflight           bool
+	PreflightMinSavings float64
+
+	// Checks names the validation checks run, in order, before an output
+	// replaces its original (see the validator package). CheckCommand is an
+	// external program run as the "command" check.
+	Checks       []string
+	CheckCommand string
+
+	// DurationDrift is the container duration difference tolerated, in seconds.
+	DurationDrift float64
+
+	// Quality floors: outputs whose worst frame scores below *Min, or whose
+	// 5th-percentile frame scores below *P5, are rejected. VMAF is used when
+	// ffmpeg has libvmaf, otherwise both SSIM and PSNR.
+	VMAFMin, VMAFP5 float64
+	SSIMMin, SSIMP5 float64
+	PSNRMin, PSNRP5 float64
+
+	// DecodeMaxErrors is how many decoder errors a full decode of the output
+	// may report.
+	DecodeMaxErrors int
+
+	// Review parks validated outputs in the state folder until someone
+	// approves or rejects them, instead of replacing originals right away.
+	Review bool
+
+	// Compare renders a contact sheet and comparison clip of every
+	// validated output (see the compare command).
+	Compare bool
+
+	// ProbeWorkersLocal and ProbeWorkersRemote bound how many probes a scan
+	// runs at once, for local folders and over SSH (where each probe covers
+	// a batch of files).
+	ProbeWorkersLocal  int
+	ProbeWorkersRemote int
+
+	// ScanWarmup is how long a scan gathers candidates before offering the
+	// first one: longer waits for a better pick, shorter starts sooner.
+	ScanWarmup time.Duration
+
+	// FolderWeights multiplies the ranking score of files under a folder
+	// (relative to the library root); 0 skips the folder. Set with one
+	// "folder_weight = <multiplier> <folder>" line per folder.
+	FolderWeights map[string]float64
+}
+
+// DefaultChecks is the validation chain when a library does not set checks.
+var DefaultChecks = []string{"size", "min-size", "duration", "streams", "quality", "decode"}
+
+// Default returns the settings used when the library has no config file.
+func Default() Library {
+	return Library{
+		AV1Mode:             ModeCRF,
+		BitrateFraction:     0.9,
+		PreflightMinSavings: 0.10,
+		Checks:              DefaultChecks,
+		DurationDrift:       5,
+		VMAFMin:             60,
+		VMAFP5:              80,
+		SSIMMin:             0.85,
+		SSIMP5:              0.93,
+		PSNRMin:             25,
+		PSNRP5:              32,
+		ProbeWorkersLocal:   4,
+		ProbeWorkersRemote:  6,
+		ScanWarmup:          30 * time.Second,
+	}
+}
+
+// Load reads the config file under rootPath. A missing file yields the defaults.
+func Load(fsys vfs.FS, rootPath string) (Library, error) {
+	lib := Default()
+	p := paths.InRoot(rootPath, paths.ConfigFile)
+	rc, err := fsys.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lib, nil
+		}
+		return lib, fmt.Errorf("open %s: %w", p, err)
+	}
+	defer rc.Close()
+
+	sc := bufio.NewScanner(rc)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return lib, fmt.Errorf("%s:%d: expected key = value", p, n)
+		}
+		if err := lib.set(strings.TrimSpace(key), strings.TrimSpace(val)); err != nil {
+			return lib, fmt.Errorf("%s:%d: %w", p, n, err)
+		}
+	}
+	if a := lib.HEVCArchive; a != "" && !strings.HasPrefix(a, "/") && !filepath.IsAbs(a) {
+		lib.HEVCArchive = paths.InRoot(rootPath, a)
+	}
+	return lib, sc.Err()
+}
+
+func parseFraction(val string) (float64, error) {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, err
+	}
+	if f <= 0 || f > 1 {
+		return 0, fmt.Errorf("%v not in (0, 1]", f)
+	}
+	return f, nil
+}
+
+func parseScore(val string) (float64, error) {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 {
+		return 0, fmt.Errorf("%v is negative", f)
+	}
+	return f, nil
+}
+
+func parseWorkers(val string) (int, error) {
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 {
+		return 0, fmt.Errorf("%d is less than 1", n)
+	}
+	return n, nil
+}
+
+// setFolderWeight parses "<multiplier> <folder>"; the folder may contain
+// spaces.
+func (l *Library) setFolderWeight(val string) error {
+	ws, folder, ok := strings.Cut(val, " ")
+	folder = strings.TrimSpace(folder)
+	if !ok || folder == "" {
+		return fmt.Errorf("want <multiplier> <folder>")
+	}
+	w, err := strconv.ParseFloat(ws, 64)
+	if err != nil {
+		return err
+	}
+	if w < 0 {
+		return fmt.Errorf("%v is negative", w)
+	}
+	if l.FolderWeights == nil {
+		l.FolderWeights = make(map[string]float64)
+	}
+	l.FolderWeights[folder] = w
+	return nil
+}
+
+// legacyChecks maps the old per-check switches to the checks they control.
+var legacyChecks = map[string]string{
+	"stream_check":  "streams",
+	"quality_check": "quality",
+	"decode_check":  "decode",
+}
+
+// toggleCheck adds the named check to the end of the chain if missing, or
+// removes it.
+func (l *Library) toggleCheck(name string, on bool) {
+	var names []string
+	have := false
+	for _, n := range l.Checks {
+		if n == name {
+			have = true
+			if !on {
+				continue
+			}
+		}
+		names = append(names, n)
+	}
+	if on && !have {
+		names = append(names, name)
+	}
+	l.Checks = names
+}
+
+func (l *Library) set(key, val string) error {
+	var err error
+	switch key {
+	case "early_abort":
+		l.EarlyAbort, err = strconv.ParseBool(val)
+	case "av1_mode":
+		switch val {
+		case ModeCRF, ModeVBR, ModeHybrid:
+			l.AV1Mode = val
+		default:
+			err = fmt.Errorf("want %s, %s or %s", ModeCRF, ModeVBR, ModeHybrid)
+		}
+	case "bitrate_fraction":
+		l.BitrateFraction, err = parseFraction(val)
+	case "hevc_archive":
+		l.HEVCArchive = val
+	case "preflight":
+		l.Preflight, err = strconv.ParseBool(val)
+	case "preflight_min_savings":
+		l.PreflightMinSavings, err = parseFraction(val)
+	case "checks":
+		var names []string
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			err = fmt.Errorf("empty; outputs would replace originals unvalidated")
+		} else {
+			l.Checks = names
+		}
+	case "stream_check", "quality_check", "decode_check":
+		// Switches from before checks existed, kept as shorthands for it.
+		var on bool
+		if on, err = strconv.ParseBool(val); err == nil {
+			l.toggleCheck(legacyChecks[key], on)
+		}
+	case "check_command":
+		l.CheckCommand = val
+	case "duration_drift":
+		l.DurationDrift, err = parseScore(val)
+	case "vmaf_min":
+		l.VMAFMin, err = parseScore(val)
+	case "vmaf_p5":
+		l.VMAFP5, err = parseScore(val)
+	case "ssim_min":
+		l.SSIMMin, err = parseScore(val)
+	case "ssim_p5":
+		l.SSIMP5, err = parseScore(val)
+	case "psnr_min":
+		l.PSNRMin, err = parseScore(val)
+	case "psnr_p5":
+		l.PSNRP5, err = parseScore(val)
+	case "decode_max_errors":
+		l.DecodeMaxErrors, err = strconv.Atoi(val)
+		if err == nil && l.DecodeMaxErrors < 0 {
+			err = fmt.Errorf("%d is negative", l.DecodeMaxErrors)
+		}
+	case "review":
+		l.Review, err = strconv.ParseBool(val)
+	case "compare":
+		l.Compare, err = strconv.ParseBool(val)
+	case "probe_workers_local":
+		l.ProbeWorkersLocal, err = parseWorkers(val)
+	case "probe_workers_remote":
+		l.ProbeWorkersRemote, err = parseWorkers(val)
+	case "folder_weight":
+		err = l.setFolderWeight(val)
+	case "scan_warmup":
+		l.ScanWarmup, err = time.ParseDuration(val)
+		if err == nil && l.ScanWarmup < 0 {
+			err = fmt.Errorf("%s is negative", val)
+		}
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", key, err)
+	}
+	return nil
+}
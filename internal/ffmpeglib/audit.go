@@ -0,0 +1,116 @@
+package ffmpeglib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandLog collects the ffmpeg command lines run on behalf of one
+// conversion and the CPU time they used. Attach it to a context with
+// WithCommandLog; every encode run under that context records into it.
+type CommandLog struct {
+	mu       sync.Mutex
+	commands [][]string
+	cpu      time.Duration
+}
+
+type commandLogKey struct{}
+
+// WithCommandLog returns a context whose encodes record into l.
+func WithCommandLog(ctx context.Context, l *CommandLog) context.Context {
+	return context.WithValue(ctx, commandLogKey{}, l)
+}
+
+func commandLogFrom(ctx context.Context) *CommandLog {
+	l, _ := ctx.Value(commandLogKey{}).(*CommandLog)
+	return l
+}
+
+func (l *CommandLog) record(bin string, args []string, cmd *exec.Cmd) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.commands = append(l.commands, append([]string{bin}, args...))
+	if ps := cmd.ProcessState; ps != nil {
+		l.cpu += ps.UserTime() + ps.SystemTime()
+	}
+}
+
+// Commands returns the recorded command lines, program first.
+func (l *CommandLog) Commands() [][]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([][]string(nil), l.commands...)
+}
+
+// CPU returns the user + system time of the recorded commands.
+func (l *CommandLog) CPU() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.cpu
+}
+
+// ProbeJSON returns ffprobe's full format and stream report for inPath.
+func (e *Encoder) ProbeJSON(ctx context.Context, inPath string) (json.RawMessage, error) {
+	out, err := e.ffprobe(ctx,
+		"-v", "error",
+		"-show_format", "-show_streams",
+		"-of", "json",
+		inPath,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(out)); err != nil {
+		return nil, err
+	}
+	return json.RawMessage(compact.Bytes()), nil
+}
+
+// Versions reports the first line of "-version" for the ffmpeg that encodes
+// and the ffprobe that probes (which is remote in SSH mode).
+func (e *Encoder) Versions(ctx context.Context) map[string]string {
+	v := make(map[string]string)
+	if out, err := exec.CommandContext(ctx, e.FFmpegPath, "-version").Output(); err == nil {
+		v["ffmpeg"] = firstLine(string(out))
+	}
+	if out, err := e.ffprobe(ctx, "-version"); err == nil {
+		v["ffprobe"] = firstLine(out)
+	}
+	return v
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return strings.TrimSpace(line)
+}
+
+type commandLogJSON struct {
+	Commands [][]string `json:"commands,omitempty"`
+	CPUSec   float64    `json:"cpu_sec"`
+}
+
+// MarshalJSON lets a CommandLog be saved with a conversion awaiting review.
+func (l *CommandLog) MarshalJSON() ([]byte, error) {
+	return json.Marshal(commandLogJSON{Commands: l.Commands(), CPUSec: l.CPU().Seconds()})
+}
+
+func (l *CommandLog) UnmarshalJSON(data []byte) error {
+	var v commandLogJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.commands = v.Commands
+	l.cpu = time.Duration(v.CPUSec * float64(time.Second))
+	return nil
+}
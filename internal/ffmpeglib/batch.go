@@ -0,0 +1,100 @@
+package ffmpeglib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Batched probing: over SSH every ffprobe call costs a session and a shell,
+// which dominates probing a large library. A batch runs ffprobe on a list of
+// files in one remote command, each report followed by a marker line.
+
+const batchMarker = "--flsq-probe-end"
+
+// ffprobeEach runs ffprobe with args on each of inPaths and returns the
+// output or error per path. With ProbeExec set, one command covers them all;
+// should it fail, or a file fail inside it, those files are probed one at a
+// time so their errors read as usual.
+func (e *Encoder) ffprobeEach(ctx context.Context, inPaths []string, args ...string) ([]string, []error) {
+	outs := make([]string, len(inPaths))
+	errs := make([]error, len(inPaths))
+	var ok []bool
+	if e.ProbeExec != nil && len(inPaths) > 1 {
+		ok = e.ffprobeBatch(ctx, inPaths, args, outs)
+	}
+	for i, p := range inPaths {
+		if ok != nil && ok[i] {
+			continue
+		}
+		outs[i], errs[i] = e.ffprobe(ctx, append(args[:len(args):len(args)], p)...)
+	}
+	return outs, errs
+}
+
+// ffprobeBatch probes inPaths in one remote command, filling outs and
+// reporting which files succeeded. A nil result means the batch failed.
+func (e *Encoder) ffprobeBatch(ctx context.Context, inPaths, args []string, outs []string) []bool {
+	cmd := shQuote(e.FFprobePath)
+	for _, a := range args {
+		cmd += " " + shQuote(a)
+	}
+	script := fmt.Sprintf(`for f do %s "$f" </dev/null 2>/dev/null; printf '\n%s %%d\n' $?; done`, cmd, batchMarker)
+	stdout, _, err := e.ProbeExec(ctx, "sh", append([]string{"-c", script, "sh"}, inPaths...)...)
+	if err != nil {
+		return nil
+	}
+
+	ok := make([]bool, 0, len(inPaths))
+	var cur strings.Builder
+	for _, line := range strings.SplitAfter(string(stdout), "\n") {
+		status, isMarker := strings.CutPrefix(strings.TrimSpace(line), batchMarker+" ")
+		if !isMarker {
+			cur.WriteString(line)
+			continue
+		}
+		if len(ok) == len(inPaths) {
+			return nil
+		}
+		code, err := strconv.Atoi(status)
+		ok = append(ok, err == nil && code == 0)
+		outs[len(ok)-1] = cur.String()
+		cur.Reset()
+	}
+	if len(ok) != len(inPaths) {
+		return nil
+	}
+	return ok
+}
+
+// shQuote quotes s for a POSIX shell.
+func shQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// ProbeBatch is ProbeAll for many files, in one remote command when probing
+// over SSH.
+func (e *Encoder) ProbeBatch(ctx context.Context, inPaths []string) ([]ProbeRecord, []error) {
+	outs, errs := e.ffprobeEach(ctx, inPaths, probeAllArgs...)
+	recs := make([]ProbeRecord, len(inPaths))
+	for i := range inPaths {
+		if errs[i] == nil {
+			recs[i], errs[i] = parseProbeAll(outs[i])
+		}
+	}
+	return recs, errs
+}
+
+// ProbeStreamsBatch is ProbeStreams for many files, in one remote command
+// when probing over SSH.
+func (e *Encoder) ProbeStreamsBatch(ctx context.Context, inPaths []string) ([][]StreamInfo, []error) {
+	outs, errs := e.ffprobeEach(ctx, inPaths, probeStreamsArgs...)
+	streams := make([][]StreamInfo, len(inPaths))
+	for i := range inPaths {
+		if errs[i] == nil {
+			streams[i], errs[i] = parseStreams(outs[i])
+		}
+	}
+	return streams, errs
+}
@@ -0,0 +1,100 @@
+package ffmpeglib
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Visual comparison for reviewing an encode: matching frames of the source
+// and the output tiled into a contact sheet, and a short clip showing both at
+// once. Both run where analysis runs, so outputs may be library paths.
+
+const (
+	sheetTileW, sheetTileH = 640, 360
+	clipW, clipH           = 960, 540 // each side of a side-by-side clip; a wipe is twice both
+)
+
+// fit scales a picture into w x h, letterboxed, with square pixels.
+func fit(w, h int) string {
+	return fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:-1:-1,setsar=1", w, h, w, h)
+}
+
+// ContactSheet writes a PNG with one row per timestamp: the source frame on
+// the left, the output frame on the right.
+func (e *Encoder) ContactSheet(ctx context.Context, refPath, distPath string, times []float64, outPath string) error {
+	if len(times) == 0 {
+		return fmt.Errorf("no timestamps")
+	}
+	var args []string
+	var graph, rows strings.Builder
+	for i, t := range times {
+		ss := strconv.FormatFloat(t, 'f', 3, 64)
+		args = append(args, "-ss", ss, "-i", refPath, "-ss", ss, "-i", distPath)
+		for side := 0; side < 2; side++ {
+			fmt.Fprintf(&graph, "[%d:v]trim=end_frame=1,setpts=PTS-STARTPTS,%s,format=rgb24[v%d];",
+				2*i+side, fit(sheetTileW, sheetTileH), 2*i+side)
+		}
+		fmt.Fprintf(&graph, "[v%d][v%d]hstack[r%d];", 2*i, 2*i+1, i)
+		fmt.Fprintf(&rows, "[r%d]", i)
+	}
+	if len(times) == 1 {
+		graph.WriteString("[r0]null[out]")
+	} else {
+		fmt.Fprintf(&graph, "%svstack=inputs=%d[out]", rows.String(), len(times))
+	}
+
+	args = append([]string{"-nostdin", "-hide_banner", "-v", "error"}, args...)
+	args = append(args, "-filter_complex", graph.String(), "-map", "[out]", "-frames:v", "1", "-y", outPath)
+	_, err := e.analyze(ctx, args...)
+	return err
+}
+
+// CompareClip renders length seconds from start as one video: source left
+// and output right, or with wipe, a divider sweeping across the frame from
+// source to output.
+func (e *Encoder) CompareClip(ctx context.Context, refPath, distPath string, start, length float64, wipe bool, outPath string) error {
+	ss := strconv.FormatFloat(start, 'f', 3, 64)
+	t := strconv.FormatFloat(length, 'f', 3, 64)
+	args := []string{
+		"-nostdin", "-hide_banner", "-v", "error",
+		"-ss", ss, "-t", t, "-i", refPath,
+		"-ss", ss, "-t", t, "-i", distPath,
+	}
+
+	var graph string
+	if wipe {
+		prep := "setpts=PTS-STARTPTS," + fit(2*clipW, 2*clipH) + ",format=yuv420p"
+		graph = fmt.Sprintf("[0:v]%s[a];[1:v]%s[b];[a][b]blend=all_expr='if(lt(X,W*T/%s),B,A)'[out]", prep, prep, t)
+	} else {
+		prep := "setpts=PTS-STARTPTS," + fit(clipW, clipH) + ",format=yuv420p"
+		graph = fmt.Sprintf("[0:v]%s[a];[1:v]%s[b];[a][b]hstack[out]", prep, prep)
+	}
+	args = append(args, "-filter_complex", graph, "-map", "[out]", "-an")
+
+	// Any player should open the clip, so prefer H.264.
+	if e.hasEncoder(ctx, "libx264") {
+		args = append(args, "-c:v", "libx264", "-crf", "16", "-preset", "fast")
+	} else {
+		args = append(args, "-c:v", "mpeg4", "-q:v", "2")
+	}
+	args = append(args, "-y", outPath)
+	_, err := e.analyze(ctx, args...)
+	return err
+}
+
+// hasEncoder reports whether the ffmpeg that runs analysis passes has the
+// named encoder.
+func (e *Encoder) hasEncoder(ctx context.Context, name string) bool {
+	out, err := e.analyze(ctx, "-hide_banner", "-encoders")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) >= 2 && f[1] == name {
+			return true
+		}
+	}
+	return false
+}
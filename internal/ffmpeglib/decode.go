@@ -0,0 +1,135 @@
+package ffmpeglib
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// DecodeReport is the outcome of fully decoding a file.
+type DecodeReport struct {
+	Frames int64    // video frames decoded
+	Errors int      // decoder error messages
+	First  []string // the first few error messages
+}
+
+const keepDecodeErrors = 5
+
+// DecodeCheck decodes the whole primary video stream and all audio of
+// inPath, discarding the output, and counts what the decoders complain about.
+// Demuxer and muxer messages are not decode errors and are left out.
+func (e *Encoder) DecodeCheck(ctx context.Context, inPath string) (DecodeReport, error) {
+	decoders := e.decoders(ctx)
+	out, stderr, err := e.analyzeOutput(ctx,
+		"-nostdin", "-hide_banner", "-v", "error",
+		"-progress", "pipe:1", "-nostats",
+		"-i", inPath,
+		"-map", "0:v:0", "-map", "0:a?",
+		"-f", "null", "-",
+	)
+	if ctx.Err() != nil {
+		return DecodeReport{}, ctx.Err()
+	}
+
+	var rep DecodeReport
+	var other []string
+	for _, line := range strings.Split(out, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "frame="); ok {
+			if n, perr := strconv.ParseInt(v, 10, 64); perr == nil {
+				rep.Frames = n
+			}
+		}
+	}
+	for _, line := range strings.Split(stderr, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !decodeError(line, decoders) {
+			other = append(other, line)
+			continue
+		}
+		rep.Errors++
+		if len(rep.First) < keepDecodeErrors {
+			rep.First = append(rep.First, line)
+		}
+	}
+	// A decode that dies early still reports how far it got; the caller
+	// judges that by the frame count.
+	if err != nil && rep.Frames == 0 {
+		return rep, errors.New("decode failed: " + strings.Join(append(rep.First, other...), "; "))
+	}
+	return rep, nil
+}
+
+// decodeError reports whether an ffmpeg log line comes from decoding: it is
+// tagged with a decoder's context or an input stream's decoding context, or
+// is the untagged per-stream summary older ffmpeg prints.
+func decodeError(line string, decoders map[string]bool) bool {
+	name, ok := logContext(line)
+	if !ok {
+		return strings.HasPrefix(line, "Error while decoding")
+	}
+	return decoders[name] || strings.HasPrefix(name, "vist#") ||
+		strings.HasPrefix(name, "aist#") || strings.HasPrefix(name, "dec:")
+}
+
+// logContext returns the name in the "[name @ 0x…]" tag ffmpeg prefixes
+// log lines with.
+func logContext(line string) (string, bool) {
+	tag, _, ok := strings.Cut(line, "]")
+	if !ok || !strings.HasPrefix(tag, "[") {
+		return "", false
+	}
+	name, _, ok := strings.Cut(tag[1:], " @ ")
+	return name, ok
+}
+
+// decoders lists the decoders of the ffmpeg that runs analysis passes.
+func (e *Encoder) decoders(ctx context.Context) map[string]bool {
+	out, err := e.analyze(ctx, "-hide_banner", "-decoders")
+	if err != nil {
+		return nil
+	}
+	names := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) >= 2 && len(f[0]) == 6 {
+			names[f[1]] = true
+		}
+	}
+	return names
+}
+
+// VideoFrameCount counts the packets of the primary video stream, which is
+// the frame count without the cost of decoding.
+func (e *Encoder) VideoFrameCount(ctx context.Context, inPath string) (int64, error) {
+	return e.countVideo(ctx, inPath, "packets")
+}
+
+// DecodedFrameCount counts the frames the primary video stream decodes to.
+// It differs from VideoFrameCount where packets are not frames: field-coded
+// video, packed-bitstream placeholders, dropped duplicates.
+func (e *Encoder) DecodedFrameCount(ctx context.Context, inPath string) (int64, error) {
+	return e.countVideo(ctx, inPath, "frames")
+}
+
+// countVideo counts the "packets" or "frames" of the primary video stream.
+func (e *Encoder) countVideo(ctx context.Context, inPath, what string) (int64, error) {
+	out, err := e.ffprobe(ctx,
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-count_"+what,
+		"-show_entries", "stream=nb_read_"+what,
+		"-of", "default=nokey=1:noprint_wrappers=1",
+		inPath,
+	)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(out)
+	if s == "" || s == "N/A" {
+		return 0, errors.New("frame count unavailable")
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
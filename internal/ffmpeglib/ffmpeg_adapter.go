@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -20,12 +22,19 @@ import (
 
 var ErrAlreadyAV1 = errors.New("input already AV1")
 
+// ErrNoProgress is returned when ffmpeg stops reporting progress and is killed.
+var ErrNoProgress = errors.New("no progress")
+
 type ExecFunc func(ctx context.Context, name string, args ...string) (stdout []byte, stderr []byte, err error)
 
 type Encoder struct {
 	FFmpegPath  string
 	FFprobePath string
 	ProbeExec   ExecFunc
+
+	// AnalyzeExec, when set, runs ffmpeg analysis passes (quality metrics,
+	// decode checks) where the files live, like ProbeExec does for ffprobe.
+	AnalyzeExec ExecFunc
 }
 
 func New() *Encoder {
@@ -35,17 +44,37 @@ func New() *Encoder {
 	}
 }
 
+// Local returns a copy of e that probes files on this machine, for working
+// on downloaded copies of remote files.
+func (e *Encoder) Local() *Encoder {
+	l := *e
+	l.ProbeExec = nil
+	l.AnalyzeExec = nil
+	return &l
+}
+
 type AV1Options struct {
-	CRF         int
-	Preset      int
+	CRF    int
+	Preset int
+
+	// TargetBitrate (bits/s) switches to VBR rate control instead of CRF.
+	// MaxBitrate (bits/s) caps a CRF encode (capped CRF). Zero disables each.
+	TargetBitrate int64
+	MaxBitrate    int64
+
 	Threads     int
 	PixFmt      string
 	Container   string
 	MetaComment string
+	Metadata    map[string]string // further container tags
 
 	SkipIfAlreadyAV1 bool
 	DropSubtitles    bool
 	ExtraFFmpegArgs  []string
+
+	// ManifestPath, when set, encodes the video in resumable time-based
+	// segments and records finished segments there (see segments.go).
+	ManifestPath string
 }
 
 func (o AV1Options) withDefaults() AV1Options {
@@ -64,8 +93,37 @@ func (o AV1Options) withDefaults() AV1Options {
 	return o
 }
 
+// ProgressLine is one key/value block of ffmpeg's -progress output.
 type ProgressLine struct {
-	Raw string
+	Frame     int64
+	FPS       float64
+	OutTime   time.Duration // position reached in the output
+	TotalSize int64         // bytes written so far
+	Speed     float64       // multiple of realtime; 0 when unknown
+	Done      bool          // last block (progress=end)
+}
+
+// set applies one key=value pair from a -progress block. It returns true
+// when the pair ends the block.
+func (p *ProgressLine) set(key, val string) bool {
+	switch key {
+	case "frame":
+		p.Frame, _ = strconv.ParseInt(val, 10, 64)
+	case "fps":
+		p.FPS, _ = strconv.ParseFloat(val, 64)
+	case "out_time_us":
+		if us, err := strconv.ParseInt(val, 10, 64); err == nil && us >= 0 {
+			p.OutTime = time.Duration(us) * time.Microsecond
+		}
+	case "total_size":
+		p.TotalSize, _ = strconv.ParseInt(val, 10, 64)
+	case "speed":
+		p.Speed, _ = strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(val), "x"), 64)
+	case "progress":
+		p.Done = val == "end"
+		return true
+	}
+	return false
 }
 
 func (e *Encoder) EnsureAvailable(ctx context.Context) error {
@@ -92,6 +150,10 @@ func (e *Encoder) EncodeToAV1SVT(ctx context.Context, inPath, outPath string, op
 		return err
 	}
 
+	if opt.ManifestPath != "" {
+		return e.encodeAV1Segmented(ctx, inPath, outPath, opt, progress)
+	}
+
 	outExt := filepath.Ext(outPath)
 	tmpPath := outPath[:len(outPath)-len(outExt)] + ".tmp-flsq-av1-" + paths.Hostname() + outExt
 	_ = os.Remove(tmpPath)
@@ -102,13 +164,9 @@ func (e *Encoder) EncodeToAV1SVT(ctx context.Context, inPath, outPath string, op
 		"-y",
 		"-i", inPath,
 		"-map", "0:v", "-map", "0:a?",
-		"-c:v", "libsvtav1",
-		"-crf", strconv.Itoa(opt.CRF),
-		"-preset", strconv.Itoa(opt.Preset),
-		"-pix_fmt", opt.PixFmt,
-		"-g", "240",
-		"-c:a", "copy",
 	}
+	args = append(args, av1VideoArgs(opt)...)
+	args = append(args, "-c:a", "copy")
 
 	if opt.DropSubtitles {
 		args = append(args, "-sn")
@@ -117,6 +175,7 @@ func (e *Encoder) EncodeToAV1SVT(ctx context.Context, inPath, outPath string, op
 	}
 
 	args = append(args, "-metadata", "comment="+opt.MetaComment)
+	args = append(args, metadataArgs(opt.Metadata)...)
 
 	if opt.Threads > 0 {
 		args = append(args, "-threads", strconv.Itoa(opt.Threads))
@@ -141,6 +200,26 @@ func (e *Encoder) EncodeToAV1SVT(ctx context.Context, inPath, outPath string, op
 	return nil
 }
 
+// av1VideoArgs returns the SVT-AV1 video encoder settings for opt.
+func av1VideoArgs(opt AV1Options) []string {
+	args := []string{"-c:v", "libsvtav1"}
+	if opt.TargetBitrate > 0 {
+		args = append(args, "-b:v", strconv.FormatInt(opt.TargetBitrate, 10))
+	} else {
+		args = append(args, "-crf", strconv.Itoa(opt.CRF))
+		if opt.MaxBitrate > 0 {
+			args = append(args,
+				"-maxrate", strconv.FormatInt(opt.MaxBitrate, 10),
+				"-bufsize", strconv.FormatInt(2*opt.MaxBitrate, 10))
+		}
+	}
+	return append(args,
+		"-preset", strconv.Itoa(opt.Preset),
+		"-pix_fmt", opt.PixFmt,
+		"-g", "240",
+	)
+}
+
 // Progress check interval and timeout: if no stderr line from ffmpeg for
 // noProgressTimeout, the encode is treated as stuck and cancelled.
 const (
@@ -148,13 +227,16 @@ const (
 	noProgressTimeout     = 15 * time.Minute
 )
 
-// runCmdStreaming executes a command, streaming stderr lines to the progress
-// callback. Stdout is drained and discarded. If no progress line is received
-// for noProgressTimeout, the command is cancelled (stuck encode).
+// runCmdStreaming executes ffmpeg with -progress on stdout, parsing each
+// key/value block into a ProgressLine for the progress callback. Stderr is
+// drained. If neither stream produces output for noProgressTimeout, the
+// command is cancelled (stuck encode).
 func runCmdStreaming(ctx context.Context, bin string, args []string, progress func(ProgressLine)) error {
 	progressCtx, progressCancel := context.WithCancel(ctx)
 	defer progressCancel()
 
+	args = append([]string{"-progress", "pipe:1", "-nostats"}, args...)
+
 	cmd := exec.CommandContext(progressCtx, bin, args...)
 	configureCmd(cmd, bin, args)
 
@@ -175,8 +257,29 @@ func runCmdStreaming(ctx context.Context, bin string, args []string, progress fu
 	var lastProgressMu sync.Mutex
 	lastProgress := time.Now()
 
+	touch := func() {
+		lastProgressMu.Lock()
+		lastProgress = time.Now()
+		lastProgressMu.Unlock()
+	}
+
 	go func() {
 		defer func() { done <- struct{}{} }()
+		sc := bufio.NewScanner(stdoutPipe)
+		var p ProgressLine
+		for sc.Scan() {
+			touch()
+			key, val, ok := strings.Cut(sc.Text(), "=")
+			if !ok {
+				continue
+			}
+			if p.set(key, val) {
+				if progress != nil {
+					progress(p)
+				}
+				p = ProgressLine{}
+			}
+		}
 		_, _ = io.Copy(io.Discard, stdoutPipe)
 	}()
 
@@ -187,12 +290,7 @@ func runCmdStreaming(ctx context.Context, bin string, args []string, progress fu
 		buf := make([]byte, 0, 64*1024)
 		sc.Buffer(buf, 2*1024*1024)
 		for sc.Scan() {
-			lastProgressMu.Lock()
-			lastProgress = time.Now()
-			lastProgressMu.Unlock()
-			if progress != nil {
-				progress(ProgressLine{Raw: sc.Text()})
-			}
+			touch()
 		}
 	}()
 
@@ -231,9 +329,10 @@ func runCmdStreaming(ctx context.Context, bin string, args []string, progress fu
 	<-done
 
 	err = cmd.Wait()
+	commandLogFrom(ctx).record(bin, args, cmd)
 	select {
 	case <-noProgressCancel:
-		return fmt.Errorf("encode cancelled: no progress for %v", noProgressTimeout)
+		return fmt.Errorf("encode cancelled: %w for %v", ErrNoProgress, noProgressTimeout)
 	default:
 	}
 	if err != nil {
@@ -314,6 +413,48 @@ func (e *Encoder) VideoBitrate(ctx context.Context, inPath string) (int64, error
 	return strconv.ParseInt(s, 10, 64)
 }
 
+// SourceVideoBitrate returns the video bitrate in bits/s. When the stream
+// doesn't report one (common for MKV), it falls back to the container
+// bitrate minus the audio streams' bitrates.
+func (e *Encoder) SourceVideoBitrate(ctx context.Context, inPath string) (int64, error) {
+	if br, err := e.VideoBitrate(ctx, inPath); err == nil && br > 0 {
+		return br, nil
+	}
+	out, err := e.ffprobe(ctx,
+		"-v", "error",
+		"-show_entries", "format=bit_rate",
+		"-of", "default=nokey=1:noprint_wrappers=1",
+		inPath,
+	)
+	if err != nil {
+		return 0, err
+	}
+	total, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil || total <= 0 {
+		return 0, errors.New("container bitrate unavailable")
+	}
+	out, err = e.ffprobe(ctx,
+		"-v", "error",
+		"-select_streams", "a",
+		"-show_entries", "stream=bit_rate",
+		"-of", "default=nokey=1:noprint_wrappers=1",
+		inPath,
+	)
+	if err != nil {
+		return 0, err
+	}
+	video := total
+	for _, line := range strings.Fields(out) {
+		if br, err := strconv.ParseInt(line, 10, 64); err == nil {
+			video -= br
+		}
+	}
+	if video <= 0 {
+		return 0, errors.New("video bitrate unavailable")
+	}
+	return video, nil
+}
+
 // VideoPixFmt returns the video stream pixel format (e.g. yuv420p, yuv420p10le).
 // Empty string and error if unavailable.
 func (e *Encoder) VideoPixFmt(ctx context.Context, inPath string) (string, error) {
@@ -343,6 +484,256 @@ func (e *Encoder) Comment(ctx context.Context, inPath string) (string, error) {
 	return strings.TrimSpace(out), nil
 }
 
+// FormatTags returns the requested container tags. Keys are matched
+// case-insensitively (Matroska may change tag case); missing tags are absent
+// from the result.
+func (e *Encoder) FormatTags(ctx context.Context, inPath string, keys ...string) (map[string]string, error) {
+	out, err := e.ffprobe(ctx,
+		"-v", "error",
+		"-show_entries", "format_tags",
+		"-of", "default=noprint_wrappers=1",
+		inPath,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(strings.TrimPrefix(strings.TrimSpace(line), "TAG:"), "=")
+		if !ok {
+			continue
+		}
+		for _, want := range keys {
+			if strings.EqualFold(k, want) {
+				tags[want] = v
+			}
+		}
+	}
+	return tags, nil
+}
+
+// VideoInfo describes the primary video stream of a file.
+type VideoInfo struct {
+	Codec    string
+	Width    int
+	Height   int
+	FPS      float64
+	Duration float64 // seconds
+	Bitrate  int64   // video bits/s, 0 if unknown
+}
+
+// ProbeRecord is a compact summary of a file, small enough to cache per file
+// in the scan index: the container, every stream, and our marker tags.
+type ProbeRecord struct {
+	Format   string            `json:"fmt,omitempty"`
+	Duration float64           `json:"dur,omitempty"` // seconds
+	Bitrate  int64             `json:"br,omitempty"`  // container bits/s
+	Tags     map[string]string `json:"tags,omitempty"`
+	Streams  []ProbeStream     `json:"st,omitempty"`
+}
+
+// ProbeStream is one stream of a ProbeRecord. Fields that do not apply to the
+// stream type are left empty.
+type ProbeStream struct {
+	Type          string  `json:"t"`
+	Codec         string  `json:"c"`
+	Width         int     `json:"w,omitempty"`
+	Height        int     `json:"h,omitempty"`
+	FPS           float64 `json:"fps,omitempty"`
+	PixFmt        string  `json:"pix,omitempty"`
+	Primaries     string  `json:"prim,omitempty"`
+	Transfer      string  `json:"trc,omitempty"`
+	Matrix        string  `json:"mat,omitempty"`
+	Range         string  `json:"rng,omitempty"`
+	Bitrate       int64   `json:"br,omitempty"` // bits/s, 0 if unknown
+	Channels      int     `json:"ch,omitempty"`
+	ChannelLayout string  `json:"lay,omitempty"`
+	Language      string  `json:"lang,omitempty"`
+	CoverArt      bool    `json:"pic,omitempty"` // attached picture, not a real video track
+}
+
+// markerTags are the container tags kept in a ProbeRecord, under these names.
+var markerTags = []string{"comment", paths.OriginalTag, paths.OriginalCodecTag}
+
+// ProbeAll reads everything the scanner caches about a file in a single
+// ffprobe call. Stream bitrates come from the stream or its Matroska BPS tag;
+// the comment tag is kept only when it is one of our markers.
+func (e *Encoder) ProbeAll(ctx context.Context, inPath string) (ProbeRecord, error) {
+	out, err := e.ffprobe(ctx, append(probeAllArgs, inPath)...)
+	if err != nil {
+		return ProbeRecord{}, err
+	}
+	return parseProbeAll(out)
+}
+
+var probeAllArgs = []string{
+	"-v", "error",
+	"-show_entries", "stream=codec_type,codec_name,width,height,avg_frame_rate,r_frame_rate,bit_rate,pix_fmt," +
+		"color_primaries,color_transfer,color_space,color_range,channels,channel_layout" +
+		":stream_disposition=attached_pic:stream_tags=BPS,language" +
+		":format=format_name,duration,bit_rate:format_tags",
+	"-of", "json",
+}
+
+func parseProbeAll(out string) (ProbeRecord, error) {
+	var probe struct {
+		Streams []struct {
+			CodecType      string            `json:"codec_type"`
+			CodecName      string            `json:"codec_name"`
+			Width          int               `json:"width"`
+			Height         int               `json:"height"`
+			AvgFrameRate   string            `json:"avg_frame_rate"`
+			RFrameRate     string            `json:"r_frame_rate"`
+			BitRate        string            `json:"bit_rate"`
+			PixFmt         string            `json:"pix_fmt"`
+			ColorPrimaries string            `json:"color_primaries"`
+			ColorTransfer  string            `json:"color_transfer"`
+			ColorSpace     string            `json:"color_space"`
+			ColorRange     string            `json:"color_range"`
+			Channels       int               `json:"channels"`
+			ChannelLayout  string            `json:"channel_layout"`
+			Disposition    map[string]int    `json:"disposition"`
+			Tags           map[string]string `json:"tags"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string            `json:"format_name"`
+			Duration   string            `json:"duration"`
+			BitRate    string            `json:"bit_rate"`
+			Tags       map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal([]byte(out), &probe); err != nil {
+		return ProbeRecord{}, fmt.Errorf("ffprobe output: %w", err)
+	}
+
+	// Matroska may change tag case.
+	tag := func(tags map[string]string, name string) string {
+		for k, v := range tags {
+			if strings.EqualFold(k, name) {
+				return v
+			}
+		}
+		return ""
+	}
+
+	var rec ProbeRecord
+	rec.Format = probe.Format.FormatName
+	rec.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	rec.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	for _, name := range markerTags {
+		v := strings.TrimSpace(tag(probe.Format.Tags, name))
+		if v == "" || (name == "comment" && !paths.IsOurComment(v)) {
+			continue
+		}
+		if rec.Tags == nil {
+			rec.Tags = make(map[string]string)
+		}
+		rec.Tags[name] = v
+	}
+	for _, st := range probe.Streams {
+		s := ProbeStream{
+			Type:          st.CodecType,
+			Codec:         st.CodecName,
+			Width:         st.Width,
+			Height:        st.Height,
+			PixFmt:        st.PixFmt,
+			Primaries:     st.ColorPrimaries,
+			Transfer:      st.ColorTransfer,
+			Matrix:        st.ColorSpace,
+			Range:         st.ColorRange,
+			Channels:      st.Channels,
+			ChannelLayout: st.ChannelLayout,
+			CoverArt:      st.Disposition["attached_pic"] == 1,
+		}
+		if lang := tag(st.Tags, "language"); lang != "und" {
+			s.Language = lang
+		}
+		if st.CodecType == "video" {
+			s.FPS = parseRate(st.AvgFrameRate)
+			if s.FPS <= 0 {
+				s.FPS = parseRate(st.RFrameRate)
+			}
+		}
+		if br, err := strconv.ParseInt(st.BitRate, 10, 64); err == nil && br > 0 {
+			s.Bitrate = br
+		} else if br, err := strconv.ParseInt(tag(st.Tags, "BPS"), 10, 64); err == nil && br > 0 {
+			s.Bitrate = br
+		}
+		rec.Streams = append(rec.Streams, s)
+	}
+	return rec, nil
+}
+
+// Comment returns the record's marker comment, empty unless it is ours.
+func (r ProbeRecord) Comment() string { return r.Tags["comment"] }
+
+// Video describes the primary video stream: the first one that is not an
+// attached picture. Its bitrate falls back to the container bitrate minus
+// the audio streams.
+func (r ProbeRecord) Video() (VideoInfo, error) {
+	var vi VideoInfo
+	found := false
+	var audio int64
+	for _, st := range r.Streams {
+		switch st.Type {
+		case "video":
+			if found || st.CoverArt {
+				continue
+			}
+			found = true
+			vi.Codec = st.Codec
+			vi.Width, vi.Height = st.Width, st.Height
+			vi.FPS = st.FPS
+			vi.Bitrate = st.Bitrate
+		case "audio":
+			audio += st.Bitrate
+		}
+	}
+	if !found || vi.Codec == "" {
+		return VideoInfo{}, errors.New("no video stream found")
+	}
+	vi.Duration = r.Duration
+	if vi.Bitrate == 0 && r.Bitrate > audio {
+		vi.Bitrate = r.Bitrate - audio
+	}
+	return vi, nil
+}
+
+// HDR reports whether the primary video stream uses a PQ or HLG transfer.
+func (r ProbeRecord) HDR() bool {
+	for _, st := range r.Streams {
+		if st.Type == "video" && !st.CoverArt {
+			return st.Transfer == "smpte2084" || st.Transfer == "arib-std-b67"
+		}
+	}
+	return false
+}
+
+// ProbeVideo reads codec, dimensions, frame rate, duration and video bitrate
+// in a single ffprobe call.
+func (e *Encoder) ProbeVideo(ctx context.Context, inPath string) (VideoInfo, error) {
+	rec, err := e.ProbeAll(ctx, inPath)
+	if err != nil {
+		return VideoInfo{}, err
+	}
+	return rec.Video()
+}
+
+// parseRate parses an ffprobe rational such as "24000/1001".
+func parseRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
 // ---- hardware encoder detection ----
 
 type hwProfile struct {
@@ -395,7 +786,9 @@ func (e *Encoder) DetectHW(ctx context.Context) HWCaps {
 	return caps
 }
 
-func (e *Encoder) EncodeToHEVCHW(ctx context.Context, inPath, outPath string, prof hwProfile, comment string, dropSubs bool, progress func(ProgressLine)) error {
+// EncodeToHEVCHW encodes with a hardware HEVC profile, writing meta as
+// container tags (e.g. "comment").
+func (e *Encoder) EncodeToHEVCHW(ctx context.Context, inPath, outPath string, prof hwProfile, meta map[string]string, dropSubs bool, progress func(ProgressLine)) error {
 	if err := os.MkdirAll(filepath.Dir(outPath), 0o755); err != nil {
 		return err
 	}
@@ -413,9 +806,7 @@ func (e *Encoder) EncodeToHEVCHW(ctx context.Context, inPath, outPath string, pr
 	} else {
 		args = append(args, "-map", "0:s?", "-c:s", "copy")
 	}
-	if comment != "" {
-		args = append(args, "-metadata", "comment="+comment)
-	}
+	args = append(args, metadataArgs(meta)...)
 	if f := containerMuxer("mkv"); f != "" {
 		args = append(args, "-f", f)
 	}
@@ -432,6 +823,22 @@ func (e *Encoder) EncodeToHEVCHW(ctx context.Context, inPath, outPath string, pr
 	return nil
 }
 
+// metadataArgs turns tags into -metadata arguments in a stable order.
+func metadataArgs(meta map[string]string) []string {
+	keys := make([]string, 0, len(meta))
+	for k, v := range meta {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var args []string
+	for _, k := range keys {
+		args = append(args, "-metadata", k+"="+meta[k])
+	}
+	return args
+}
+
 var muxerNames = map[string]string{
 	"mkv":  "matroska",
 	"webm": "webm",
@@ -460,3 +867,27 @@ func (e *Encoder) ffprobe(ctx context.Context, args ...string) (string, error) {
 	}
 	return string(out), nil
 }
+
+// analyze runs ffmpeg for its stdout (e.g. filter stats written to "-"),
+// at low priority when local.
+func (e *Encoder) analyze(ctx context.Context, args ...string) (string, error) {
+	out, stderr, err := e.analyzeOutput(ctx, args...)
+	if err != nil {
+		return "", fmt.Errorf("ffmpeg error: %w: %s", err, strings.TrimSpace(stderr))
+	}
+	return out, nil
+}
+
+// analyzeOutput is analyze for callers that also need stderr.
+func (e *Encoder) analyzeOutput(ctx context.Context, args ...string) (stdout, stderr string, err error) {
+	if e.AnalyzeExec != nil {
+		out, errOut, err := e.AnalyzeExec(ctx, e.FFmpegPath, args...)
+		return string(out), string(errOut), err
+	}
+	cmd := exec.CommandContext(ctx, e.FFmpegPath, args...)
+	configureCmd(cmd, e.FFmpegPath, args)
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	return string(out), errBuf.String(), err
+}
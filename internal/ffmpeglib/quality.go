@@ -0,0 +1,209 @@
+package ffmpeglib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Perceptual quality: short samples of the encode are compared frame by frame
+// against the same spans of the source. VMAF is used when ffmpeg is built with
+// libvmaf; otherwise SSIM and PSNR from ffmpeg's own filters.
+
+// Quality metric names.
+const (
+	MetricVMAF = "vmaf"
+	MetricSSIM = "ssim"
+	MetricPSNR = "psnr"
+)
+
+// psnrCap replaces the infinite PSNR of identical frames.
+const psnrCap = 100.0
+
+// QualityScores summarizes one metric over all sampled frames.
+type QualityScores struct {
+	Metric string
+	Mean   float64
+	Min    float64
+	P5     float64 // 5th percentile: the worst frames, ignoring outliers
+	Frames int
+}
+
+func (q QualityScores) String() string {
+	return fmt.Sprintf("%s mean=%.3f min=%.3f p5=%.3f", q.Metric, q.Mean, q.Min, q.P5)
+}
+
+// HasFilter reports whether the ffmpeg that runs analysis passes has the
+// named filter.
+func (e *Encoder) HasFilter(ctx context.Context, name string) bool {
+	out, err := e.analyze(ctx, "-hide_banner", "-filters")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if f := strings.Fields(line); len(f) >= 2 && f[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MeasureQuality compares distPath against refPath over samples of length
+// seconds starting at each of starts. It returns VMAF scores, or SSIM and
+// PSNR scores when libvmaf is unavailable.
+func (e *Encoder) MeasureQuality(ctx context.Context, refPath, distPath string, starts []float64, length float64) ([]QualityScores, error) {
+	if !e.HasFilter(ctx, "libvmaf") {
+		return e.measureQuality(ctx, refPath, distPath, starts, length, false)
+	}
+	scores, err := e.measureQuality(ctx, refPath, distPath, starts, length, true)
+	if err != nil && e.AnalyzeExec != nil && ctx.Err() == nil {
+		// Remote libvmaf logs to /dev/stdout, which not every host has;
+		// SSIM and PSNR report on stdout themselves.
+		log.Printf("quality: vmaf failed on the remote host, using ssim and psnr: %v", err)
+		return e.measureQuality(ctx, refPath, distPath, starts, length, false)
+	}
+	return scores, err
+}
+
+func (e *Encoder) measureQuality(ctx context.Context, refPath, distPath string, starts []float64, length float64, useVMAF bool) ([]QualityScores, error) {
+	frames := make(map[string][]float64)
+
+	for _, start := range starts {
+		ss := strconv.FormatFloat(start, 'f', 3, 64)
+		t := strconv.FormatFloat(length, 'f', 3, 64)
+		args := []string{
+			"-nostdin", "-hide_banner", "-v", "error",
+			"-ss", ss, "-t", t, "-i", distPath,
+			"-ss", ss, "-t", t, "-i", refPath,
+		}
+		// Both sides are normalized to the same format and timeline; the
+		// encode keeps the source's dimensions, so no scaling is needed.
+		prep := "[0:v]setpts=PTS-STARTPTS,format=yuv420p%s;[1:v]setpts=PTS-STARTPTS,format=yuv420p%s;"
+
+		var logFile string
+		var graph string
+		if useVMAF {
+			logPath := "/dev/stdout"
+			if e.AnalyzeExec == nil && runtime.GOOS == "windows" {
+				f, err := os.CreateTemp("", "flsq-vmaf-*.csv")
+				if err != nil {
+					return nil, err
+				}
+				f.Close()
+				logFile = f.Name()
+				logPath = filterEscape(logFile)
+			}
+			graph = fmt.Sprintf(prep, "[d]", "[r]") + "[d][r]libvmaf=log_fmt=csv:log_path=" + logPath
+		} else {
+			graph = fmt.Sprintf(prep, ",split[d1][d2]", ",split[r1][r2]") +
+				"[d1][r1]ssim=stats_file=-;[d2][r2]psnr=stats_file=-"
+		}
+		args = append(args, "-lavfi", graph, "-f", "null", "-")
+
+		out, err := e.analyze(ctx, args...)
+		if logFile != "" {
+			if data, readErr := os.ReadFile(logFile); readErr == nil {
+				out = string(data)
+			}
+			_ = os.Remove(logFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("quality sample at %.0fs: %w", start, err)
+		}
+		if useVMAF {
+			frames[MetricVMAF] = append(frames[MetricVMAF], parseVMAFLog(out)...)
+		} else {
+			ssim, psnr := parseStats(out)
+			frames[MetricSSIM] = append(frames[MetricSSIM], ssim...)
+			frames[MetricPSNR] = append(frames[MetricPSNR], psnr...)
+		}
+	}
+
+	metrics := []string{MetricSSIM, MetricPSNR}
+	if useVMAF {
+		metrics = []string{MetricVMAF}
+	}
+	var scores []QualityScores
+	for _, m := range metrics {
+		if len(frames[m]) == 0 {
+			return nil, fmt.Errorf("no %s scores produced", m)
+		}
+		scores = append(scores, summarize(m, frames[m]))
+	}
+	return scores, nil
+}
+
+func summarize(metric string, vals []float64) QualityScores {
+	sort.Float64s(vals)
+	var sum float64
+	for _, v := range vals {
+		sum += v
+	}
+	return QualityScores{
+		Metric: metric,
+		Mean:   sum / float64(len(vals)),
+		Min:    vals[0],
+		P5:     vals[len(vals)*5/100],
+		Frames: len(vals),
+	}
+}
+
+// parseVMAFLog reads the per-frame "vmaf" column of a libvmaf CSV log.
+func parseVMAFLog(out string) []float64 {
+	col := -1
+	var vals []float64
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if col < 0 {
+			for i, f := range fields {
+				if f == "vmaf" {
+					col = i
+				}
+			}
+			continue
+		}
+		if col >= len(fields) {
+			continue
+		}
+		if v, err := strconv.ParseFloat(fields[col], 64); err == nil {
+			vals = append(vals, v)
+		}
+	}
+	return vals
+}
+
+// parseStats reads per-frame lines from the ssim ("All:0.98") and psnr
+// ("psnr_avg:41.2") filters' stats output.
+func parseStats(out string) (ssim, psnr []float64) {
+	for _, line := range strings.Split(out, "\n") {
+		for _, f := range strings.Fields(line) {
+			key, val, ok := strings.Cut(f, ":")
+			if !ok {
+				continue
+			}
+			v, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "All":
+				ssim = append(ssim, v)
+			case "psnr_avg":
+				psnr = append(psnr, math.Min(v, psnrCap))
+			}
+		}
+	}
+	return ssim, psnr
+}
+
+// filterEscape escapes a path for use as a filter option value.
+func filterEscape(p string) string {
+	p = strings.ReplaceAll(p, `\`, "/")
+	return strings.ReplaceAll(p, ":", `\:`)
+}
@@ -0,0 +1,398 @@
+package ffmpeglib
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+)
+
+// Resumable AV1 encoding: the video is encoded in time-based, video-only
+// segments. Each finished segment is recorded in a small manifest, so an
+// interrupted encode (Ctrl+C, reboot, stuck-progress kill) continues from the
+// last good segment. Once every segment exists they are concatenated and
+// muxed with the source's audio, subtitles and chapters.
+
+const (
+	segmentSeconds  = 600
+	segmentRetries  = 2 // extra attempts for a segment killed for lack of progress
+	manifestVersion = 1
+	manifestHeader  = "# flicksqueeze segments – do not edit | version:"
+)
+
+type segmentManifest struct {
+	inSize   int64
+	inMod    int64
+	settings string
+	done     map[int]int64 // segment index -> bytes on disk
+}
+
+func newManifest(info os.FileInfo, settings string) *segmentManifest {
+	return &segmentManifest{
+		inSize:   info.Size(),
+		inMod:    info.ModTime().Unix(),
+		settings: settings,
+		done:     make(map[int]int64),
+	}
+}
+
+// readManifest returns nil if the manifest is missing or unreadable.
+func readManifest(path string) *segmentManifest {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() {
+		return nil
+	}
+	parts := strings.SplitN(sc.Text(), "version:", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) != strconv.Itoa(manifestVersion) {
+		return nil
+	}
+
+	m := &segmentManifest{done: make(map[int]int64)}
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		switch {
+		case fields[0] == "input" && len(fields) == 3:
+			m.inSize, _ = strconv.ParseInt(fields[1], 10, 64)
+			m.inMod, _ = strconv.ParseInt(fields[2], 10, 64)
+		case fields[0] == "settings" && len(fields) == 2:
+			m.settings = fields[1]
+		case fields[0] == "seg" && len(fields) == 3:
+			i, err1 := strconv.Atoi(fields[1])
+			sz, err2 := strconv.ParseInt(fields[2], 10, 64)
+			if err1 == nil && err2 == nil {
+				m.done[i] = sz
+			}
+		}
+	}
+	return m
+}
+
+func (m *segmentManifest) matches(info os.FileInfo, settings string) bool {
+	return m.inSize == info.Size() && m.inMod == info.ModTime().Unix() && m.settings == settings
+}
+
+// write replaces the manifest atomically so a crash never leaves it half written.
+func (m *segmentManifest) write(path string) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintf(w, "%s %d\n", manifestHeader, manifestVersion)
+	fmt.Fprintf(w, "input\t%d\t%d\n", m.inSize, m.inMod)
+	fmt.Fprintf(w, "settings\t%s\n", m.settings)
+	idx := make([]int, 0, len(m.done))
+	for i := range m.done {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	for _, i := range idx {
+		fmt.Fprintf(w, "seg\t%d\t%d\n", i, m.done[i])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// DiscardSegments removes the segments and manifest of an abandoned
+// resumable encode.
+func DiscardSegments(outPath, manifestPath string) {
+	_ = os.RemoveAll(paths.SegmentDir(outPath))
+	_ = os.Remove(manifestPath)
+	_ = os.Remove(manifestPath + ".tmp")
+}
+
+func segmentCount(duration float64) int {
+	n := int(duration) / segmentSeconds
+	if float64(n*segmentSeconds) < duration {
+		n++
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func segmentPath(segDir string, i int) string {
+	return filepath.Join(segDir, fmt.Sprintf("seg-%04d.mkv", i))
+}
+
+func (e *Encoder) encodeAV1Segmented(ctx context.Context, inPath, outPath string, opt AV1Options, progress func(ProgressLine)) error {
+	info, err := os.Stat(inPath)
+	if err != nil {
+		return err
+	}
+	dur, err := e.DurationSeconds(ctx, inPath)
+	if err != nil {
+		return fmt.Errorf("cannot probe duration for segmented encode: %w", err)
+	}
+
+	segDir := paths.SegmentDir(outPath)
+	videoArgs := av1VideoArgs(opt)
+	settings := strings.Join(videoArgs, " ")
+
+	m := readManifest(opt.ManifestPath)
+	if m == nil || !m.matches(info, settings) {
+		_ = os.RemoveAll(segDir)
+		m = newManifest(info, settings)
+	}
+	if err := os.MkdirAll(segDir, 0o755); err != nil {
+		return err
+	}
+
+	n := segmentCount(dur)
+	var doneBytes int64
+	if len(m.done) > 0 {
+		log.Printf("resuming %s: %d of %d segments already encoded", filepath.Base(inPath), len(m.done), n)
+	}
+
+	for i := 0; i < n; i++ {
+		segPath := segmentPath(segDir, i)
+		if sz, ok := m.done[i]; ok {
+			if fi, err := os.Stat(segPath); err == nil && fi.Size() == sz {
+				doneBytes += sz
+				continue
+			}
+			delete(m.done, i)
+		}
+
+		// Report progress for the whole file, not just this segment.
+		offset := time.Duration(i*segmentSeconds) * time.Second
+		base := doneBytes
+		segProgress := func(p ProgressLine) {
+			if progress == nil {
+				return
+			}
+			p.OutTime += offset
+			p.TotalSize += base
+			p.Done = p.Done && i == n-1
+			progress(p)
+		}
+
+		var err error
+		for attempt := 0; ; attempt++ {
+			err = e.encodeSegment(ctx, inPath, segPath, i, n, videoArgs, opt.Threads, segProgress)
+			if err == nil || !errors.Is(err, ErrNoProgress) || attempt >= segmentRetries || ctx.Err() != nil {
+				break
+			}
+			log.Printf("segment %d/%d of %s stalled, retrying", i+1, n, filepath.Base(inPath))
+		}
+		if err != nil {
+			return fmt.Errorf("segment %d/%d: %w", i+1, n, err)
+		}
+
+		fi, err := os.Stat(segPath)
+		if err != nil {
+			return err
+		}
+		m.done[i] = fi.Size()
+		doneBytes += fi.Size()
+		if err := m.write(opt.ManifestPath); err != nil {
+			return fmt.Errorf("write segment manifest: %w", err)
+		}
+	}
+
+	if err := e.concatSegments(ctx, inPath, outPath, segDir, n, opt, nil); err != nil {
+		return err
+	}
+	DiscardSegments(outPath, opt.ManifestPath)
+	return nil
+}
+
+func (e *Encoder) encodeSegment(ctx context.Context, inPath, segPath string, i, n int, videoArgs []string, threads int, progress func(ProgressLine)) error {
+	partPath := strings.TrimSuffix(segPath, ".mkv") + ".part.mkv"
+	_ = os.Remove(partPath)
+
+	args := []string{
+		"-nostdin",
+		"-hide_banner",
+		"-y",
+		"-ss", strconv.Itoa(i * segmentSeconds),
+		"-i", inPath,
+	}
+	if i < n-1 {
+		args = append(args, "-t", strconv.Itoa(segmentSeconds))
+	}
+	args = append(args, "-map", "0:v:0", "-an", "-sn", "-dn")
+	args = append(args, videoArgs...)
+	if threads > 0 {
+		args = append(args, "-threads", strconv.Itoa(threads))
+	}
+	args = append(args, "-f", containerMuxer("mkv"), partPath)
+
+	if err := runCmdStreaming(ctx, e.FFmpegPath, args, progress); err != nil {
+		_ = os.Remove(partPath)
+		return err
+	}
+	return os.Rename(partPath, segPath)
+}
+
+// concatSegments joins the encoded segments and muxes in audio, subtitles
+// and chapters from the source.
+func (e *Encoder) concatSegments(ctx context.Context, inPath, outPath, segDir string, n int, opt AV1Options, progress func(ProgressLine)) error {
+	streams, err := e.ProbeStreams(ctx, inPath)
+	if err != nil {
+		return fmt.Errorf("cannot probe streams for segment concat: %w", err)
+	}
+	listPath := filepath.Join(segDir, "segments.txt")
+	var list strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&list, "file '%s'\n", filepath.Base(segmentPath(segDir, i)))
+	}
+	if err := os.WriteFile(listPath, []byte(list.String()), 0o644); err != nil {
+		return err
+	}
+
+	outExt := filepath.Ext(outPath)
+	tmpPath := outPath[:len(outPath)-len(outExt)] + ".tmp-flsq-av1-" + paths.Hostname() + outExt
+	_ = os.Remove(tmpPath)
+
+	args := []string{
+		"-nostdin",
+		"-hide_banner",
+		"-y",
+	}
+	// The joined segments start at 0, but the source's streams keep their
+	// offsets from its earliest stream; shift the video back into place so
+	// it stays in sync with the source's audio.
+	if lead := videoLead(streams); lead > 0 {
+		args = append(args, "-itsoffset", strconv.FormatFloat(lead, 'f', 6, 64))
+	}
+	args = append(args,
+		"-f", "concat", "-safe", "0", "-i", listPath,
+		"-i", inPath,
+		"-map", "0:v", "-map", "1:a?",
+		"-map_chapters", "1",
+		"-c:v", "copy",
+		"-c:a", "copy",
+	)
+	if opt.DropSubtitles {
+		args = append(args, "-sn")
+	} else {
+		args = append(args, "-map", "1:s?", "-c:s", "copy")
+	}
+	args = append(args, "-metadata", "comment="+opt.MetaComment)
+	args = append(args, metadataArgs(opt.Metadata)...)
+	if f := containerMuxer(opt.Container); f != "" {
+		args = append(args, "-f", f)
+	}
+	args = append(args, opt.ExtraFFmpegArgs...)
+	args = append(args, tmpPath)
+
+	if err := runCmdStreaming(ctx, e.FFmpegPath, args, progress); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// videoLead is how far the first video stream starts after the earliest
+// stream, in seconds.
+func videoLead(streams []StreamInfo) float64 {
+	first, video, found := 0.0, 0.0, false
+	for _, st := range streams {
+		if st.CoverArt || (st.Type != "video" && st.Type != "audio" && st.Type != "subtitle") {
+			continue
+		}
+		if !found || st.StartTime < first {
+			first = st.StartTime
+		}
+		found = true
+	}
+	for _, st := range streams {
+		if st.Type == "video" && !st.CoverArt {
+			video = st.StartTime
+			break
+		}
+	}
+	return video - first
+}
+
+// SampleResult summarizes a preflight sample encode.
+type SampleResult struct {
+	Seconds float64       // media time encoded
+	Bytes   int64         // encoded video bytes
+	Wall    time.Duration // wall time spent encoding
+}
+
+// SampleEncode encodes short video-only samples of inPath with the real
+// settings, starting at each of starts (seconds), and totals their size and
+// encode time. Outputs are temporary and removed.
+func (e *Encoder) SampleEncode(ctx context.Context, inPath string, opt AV1Options, starts []float64, length float64) (SampleResult, error) {
+	opt = opt.withDefaults()
+	videoArgs := av1VideoArgs(opt)
+
+	var res SampleResult
+	for _, start := range starts {
+		f, err := os.CreateTemp("", "flsq-sample-*.mkv")
+		if err != nil {
+			return res, err
+		}
+		tmp := f.Name()
+		f.Close()
+
+		args := []string{
+			"-nostdin",
+			"-hide_banner",
+			"-y",
+			"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+			"-i", inPath,
+			"-t", strconv.FormatFloat(length, 'f', 3, 64),
+			"-map", "0:v:0", "-an", "-sn", "-dn",
+		}
+		args = append(args, videoArgs...)
+		if opt.Threads > 0 {
+			args = append(args, "-threads", strconv.Itoa(opt.Threads))
+		}
+		args = append(args, "-f", containerMuxer("mkv"), tmp)
+
+		var encoded time.Duration
+		began := time.Now()
+		err = runCmdStreaming(ctx, e.FFmpegPath, args, func(p ProgressLine) {
+			encoded = p.OutTime
+		})
+		wall := time.Since(began)
+		info, statErr := os.Stat(tmp)
+		_ = os.Remove(tmp)
+		if err != nil {
+			return res, fmt.Errorf("sample at %.0fs: %w", start, err)
+		}
+		if statErr != nil {
+			return res, statErr
+		}
+		if encoded <= 0 {
+			encoded = time.Duration(length * float64(time.Second))
+		}
+		res.Seconds += encoded.Seconds()
+		res.Bytes += info.Size()
+		res.Wall += wall
+	}
+	return res, nil
+}
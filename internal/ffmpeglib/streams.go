@@ -0,0 +1,103 @@
+package ffmpeglib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StreamInfo is one stream of a container as reported by ffprobe.
+type StreamInfo struct {
+	Index         int
+	Type          string // "video", "audio", "subtitle", "attachment", "data"
+	Codec         string
+	Language      string // "" when untagged or "und"
+	Channels      int
+	ChannelLayout string
+	SampleRate    int
+	StartTime     float64 // seconds
+	Duration      float64 // seconds, 0 if unknown
+	CoverArt      bool    // attached picture, not a real video track
+}
+
+// ProbeStreams lists every stream of inPath.
+func (e *Encoder) ProbeStreams(ctx context.Context, inPath string) ([]StreamInfo, error) {
+	out, err := e.ffprobe(ctx, append(probeStreamsArgs, inPath)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseStreams(out)
+}
+
+var probeStreamsArgs = []string{
+	"-v", "error",
+	"-show_entries", "stream=index,codec_type,codec_name,channels,channel_layout,sample_rate,start_time,duration:stream_tags=language,DURATION:stream_disposition=attached_pic",
+	"-of", "json",
+}
+
+func parseStreams(out string) ([]StreamInfo, error) {
+	var probe struct {
+		Streams []struct {
+			Index         int               `json:"index"`
+			CodecType     string            `json:"codec_type"`
+			CodecName     string            `json:"codec_name"`
+			Channels      int               `json:"channels"`
+			ChannelLayout string            `json:"channel_layout"`
+			SampleRate    string            `json:"sample_rate"`
+			StartTime     string            `json:"start_time"`
+			Duration      string            `json:"duration"`
+			Tags          map[string]string `json:"tags"`
+			Disposition   map[string]int    `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(out), &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe output: %w", err)
+	}
+
+	streams := make([]StreamInfo, 0, len(probe.Streams))
+	for _, st := range probe.Streams {
+		si := StreamInfo{
+			Index:         st.Index,
+			Type:          st.CodecType,
+			Codec:         st.CodecName,
+			Channels:      st.Channels,
+			ChannelLayout: st.ChannelLayout,
+			CoverArt:      st.Disposition["attached_pic"] == 1,
+		}
+		si.SampleRate, _ = strconv.Atoi(st.SampleRate)
+		si.StartTime, _ = strconv.ParseFloat(st.StartTime, 64)
+		si.Duration, _ = strconv.ParseFloat(st.Duration, 64)
+		for k, v := range st.Tags {
+			switch strings.ToUpper(k) {
+			case "LANGUAGE":
+				if v != "und" {
+					si.Language = v
+				}
+			case "DURATION":
+				// Matroska keeps per-stream durations as tags (01:23:45.678000000).
+				if si.Duration == 0 {
+					si.Duration = parseClock(v)
+				}
+			}
+		}
+		streams = append(streams, si)
+	}
+	return streams, nil
+}
+
+// parseClock parses "HH:MM:SS.frac" into seconds, 0 if malformed.
+func parseClock(s string) float64 {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	h, err1 := strconv.ParseFloat(parts[0], 64)
+	m, err2 := strconv.ParseFloat(parts[1], 64)
+	sec, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0
+	}
+	return h*3600 + m*60 + sec
+}
@@ -0,0 +1,252 @@
+package flsq
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/scanner"
+	"github.com/snadrus/flicksqueeze/internal/validator"
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+// Audit: every finished conversion appends one JSON line to the library's
+// state folder recording how the output was made and why it was trusted, so
+// a converted movie can be explained long after the log has scrolled away.
+
+// auditRecord is one line of the audit file.
+type auditRecord struct {
+	Time     time.Time                 `json:"time"`
+	Host     string                    `json:"host"`
+	Version  string                    `json:"version,omitempty"` // flicksqueeze build
+	Type     string                    `json:"type"`
+	Mode     string                    `json:"mode"`
+	Source   auditFile                 `json:"source"`
+	Output   auditFile                 `json:"output"`
+	Encoders map[string]string         `json:"encoders,omitempty"` // "ffmpeg"/"ffprobe" -> version line
+	Commands [][]string                `json:"commands,omitempty"`
+	WallSec  float64                   `json:"wall_sec"`
+	CPUSec   float64                   `json:"cpu_sec"`
+	Pred     *scanner.Prediction       `json:"pred,omitempty"`
+	Checks   []validator.Outcome       `json:"checks"`
+	Quality  []ffmpeglib.QualityScores `json:"quality,omitempty"`
+	Decode   *ffmpeglib.DecodeReport   `json:"decode,omitempty"`
+}
+
+// auditFile describes one side of a conversion. Path is relative to the
+// library root.
+type auditFile struct {
+	Path   string          `json:"path"`
+	Codec  string          `json:"codec,omitempty"`
+	Size   int64           `json:"size"`
+	SHA256 string          `json:"sha256,omitempty"`
+	Probe  json.RawMessage `json:"probe,omitempty"` // ffprobe -show_format -show_streams
+}
+
+// appendAudit records a finished conversion. Failures are logged, never fatal:
+// the conversion itself has already succeeded.
+func appendAudit(cfg Config, conv conversion, fromCodec, origPath string, origSize int64, outPath string, outSize int64) {
+	rec := auditRecord{
+		Time:     time.Now(),
+		Host:     paths.Hostname(),
+		Version:  cfg.Version,
+		Type:     conv.EncType,
+		Mode:     conv.Mode,
+		Source:   auditFile{Path: paths.Rel(cfg.RootPath, origPath), Codec: fromCodec, Size: origSize, Probe: conv.SourceProbe},
+		Output:   auditFile{Path: paths.Rel(cfg.RootPath, outPath), Codec: conv.EncType, Size: outSize, SHA256: conv.OutputSHA256, Probe: conv.OutputProbe},
+		Encoders: cfg.Encoders,
+		WallSec:  conv.Wall.Seconds(),
+		Pred:     conv.Pred,
+		Checks:   conv.Validation.Checks,
+		Quality:  conv.Validation.Quality,
+		Decode:   conv.Validation.Decode,
+	}
+	if conv.Commands != nil {
+		rec.Commands = conv.Commands.Commands()
+		rec.CPUSec = conv.Commands.CPU().Seconds()
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("warning: audit record for %s: %v", outPath, err)
+		return
+	}
+
+	if err := cfg.FS.MkdirAll(paths.InRoot(cfg.RootPath, paths.StateDir), 0o755); err != nil {
+		log.Printf("warning: cannot create %s: %v", paths.StateDir, err)
+		return
+	}
+	f, err := cfg.FS.OpenFile(paths.InState(cfg.RootPath, paths.AuditFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("warning: cannot open audit file: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		log.Printf("warning: cannot write audit record: %v", err)
+	}
+}
+
+// parentDir is the folder holding p, for local and remote (slash) paths.
+func parentDir(p string) string {
+	if strings.HasPrefix(p, "/") {
+		return path.Dir(p)
+	}
+	return filepath.Dir(p)
+}
+
+// Show prints the audit record of a converted movie. file may name the
+// output or the original it replaced; the library root is found by walking
+// up to the nearest folder with an audit file.
+func Show(fsys vfs.FS, file string, w io.Writer) error {
+	root, rec, err := locateAudit(fsys, file)
+	if err != nil {
+		return err
+	}
+	printAudit(w, rec)
+	sheet, clip := comparisonPaths(root, rec.Source.Path)
+	if _, err := fsys.Stat(sheet); err == nil {
+		fmt.Fprintf(w, "\ncompare    %s\n           %s\n", sheet, clip)
+	}
+	return nil
+}
+
+// locateAudit finds the latest audit record of file and the library root
+// holding it.
+func locateAudit(fsys vfs.FS, file string) (rootPath string, rec auditRecord, err error) {
+	for dir := parentDir(file); ; {
+		rec, found, err := findAudit(fsys, dir, paths.Rel(dir, file))
+		if err != nil {
+			return "", rec, err
+		}
+		if found {
+			return dir, rec, nil
+		}
+		up := parentDir(dir)
+		if up == dir {
+			return "", rec, fmt.Errorf("no conversion record for %s", file)
+		}
+		dir = up
+	}
+}
+
+// findAudit returns the latest record in rootPath's audit file whose output
+// or source is rel, following files the scanner has seen move.
+func findAudit(fsys vfs.FS, rootPath, rel string) (rec auditRecord, found bool, err error) {
+	rc, err := fsys.Open(paths.InState(rootPath, paths.AuditFile))
+	if err != nil {
+		return rec, false, nil
+	}
+	defer rc.Close()
+	moves := scanner.LoadMoves(fsys, rootPath)
+	current := func(p string) string {
+		return paths.Rel(rootPath, scanner.Moved(moves, paths.InRoot(rootPath, p)))
+	}
+	sc := bufio.NewScanner(rc)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024) // probes make long lines
+	for sc.Scan() {
+		var r auditRecord
+		if json.Unmarshal(sc.Bytes(), &r) != nil {
+			continue
+		}
+		if current(r.Output.Path) == rel || current(r.Source.Path) == rel {
+			rec, found = r, true
+		}
+	}
+	return rec, found, sc.Err()
+}
+
+func printAudit(w io.Writer, r auditRecord) {
+	fmt.Fprintf(w, "converted  %s on %s", r.Time.Local().Format(time.RFC1123), r.Host)
+	if r.Version != "" {
+		fmt.Fprintf(w, " (flicksqueeze %s)", r.Version)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "source     %s\n", r.Source.Path)
+	fmt.Fprintf(w, "           %s, %s\n", r.Source.Codec, scanner.HumanSize(r.Source.Size))
+	printStreams(w, r.Source.Probe)
+	fmt.Fprintf(w, "output     %s\n", r.Output.Path)
+	fmt.Fprintf(w, "           %s (%s), %s", r.Type, r.Mode, scanner.HumanSize(r.Output.Size))
+	if r.Source.Size > 0 {
+		fmt.Fprintf(w, ", %.0f%% smaller", (1-float64(r.Output.Size)/float64(r.Source.Size))*100)
+	}
+	fmt.Fprintln(w)
+	if r.Output.SHA256 != "" {
+		fmt.Fprintf(w, "           sha256 %s\n", r.Output.SHA256)
+	}
+	printStreams(w, r.Output.Probe)
+	if r.Pred != nil {
+		fmt.Fprintf(w, "preflight  predicted %.0f%% savings in ~%.1fh\n", r.Pred.Ratio*100, r.Pred.Hours)
+	}
+	fmt.Fprintf(w, "time       %s wall, %s cpu\n",
+		(time.Duration(r.WallSec) * time.Second).Round(time.Second),
+		(time.Duration(r.CPUSec) * time.Second).Round(time.Second))
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		if v, ok := r.Encoders[name]; ok {
+			fmt.Fprintf(w, "%-10s %s\n", name, v)
+		}
+	}
+
+	fmt.Fprintln(w, "\nvalidation")
+	for _, o := range r.Checks {
+		verdict := "ok"
+		if !o.Passed {
+			verdict = "FAILED"
+		}
+		fmt.Fprintf(w, "  %-10s %-6s %s (%s)\n", o.Check, verdict, o.Detail, o.Elapsed.Round(time.Second))
+	}
+	for _, q := range r.Quality {
+		fmt.Fprintf(w, "  %s over %d frames\n", q, q.Frames)
+	}
+
+	if len(r.Commands) > 0 {
+		fmt.Fprintln(w, "\ncommands")
+		for _, c := range r.Commands {
+			fmt.Fprintf(w, "  %s\n", strings.Join(c, " "))
+		}
+	}
+}
+
+// printStreams lists the streams of an ffprobe report, one per line.
+func printStreams(w io.Writer, probe json.RawMessage) {
+	var p struct {
+		Format struct {
+			Duration string `json:"duration"`
+			BitRate  string `json:"bit_rate"`
+		} `json:"format"`
+		Streams []struct {
+			Index     int               `json:"index"`
+			CodecType string            `json:"codec_type"`
+			CodecName string            `json:"codec_name"`
+			Width     int               `json:"width"`
+			Height    int               `json:"height"`
+			Channels  int               `json:"channels"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"streams"`
+	}
+	if len(probe) == 0 || string(probe) == "null" || json.Unmarshal(probe, &p) != nil {
+		return
+	}
+	fmt.Fprintf(w, "           duration %ss, bitrate %s b/s\n", p.Format.Duration, p.Format.BitRate)
+	for _, s := range p.Streams {
+		detail := ""
+		switch s.CodecType {
+		case "video":
+			detail = fmt.Sprintf(" %dx%d", s.Width, s.Height)
+		case "audio":
+			detail = fmt.Sprintf(" %dch", s.Channels)
+		}
+		if lang := s.Tags["language"]; lang != "" {
+			detail += " " + lang
+		}
+		fmt.Fprintf(w, "           #%d %s %s%s\n", s.Index, s.CodecType, s.CodecName, detail)
+	}
+}
@@ -0,0 +1,100 @@
+package flsq
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+
+	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+// Comparisons let a reviewer look at an encode: a contact sheet of matching
+// frames and a short clip of source and output together, saved in the state
+// folder under the source's review id.
+
+const (
+	compareFrames  = 6
+	compareClipSec = 10.0
+)
+
+// comparisonPaths are where the comparison of the source at rel (relative to
+// the library root) is saved.
+func comparisonPaths(rootPath, rel string) (sheet, clip string) {
+	base := paths.CompareDir + "/" + reviewID(rel)
+	return paths.InState(rootPath, base+".png"), paths.InState(rootPath, base+".mp4")
+}
+
+// writeComparison renders the contact sheet and clip of ref (the source)
+// against dist (the output).
+func writeComparison(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, ref, dist string) (sheet, clip string, err error) {
+	dur, err := enc.DurationSeconds(ctx, dist)
+	if err != nil {
+		return "", "", err
+	}
+	if err := cfg.FS.MkdirAll(paths.InState(cfg.RootPath, paths.CompareDir), 0o755); err != nil {
+		return "", "", err
+	}
+	sheet, clip = comparisonPaths(cfg.RootPath, paths.Rel(cfg.RootPath, ref))
+
+	// Frames are spread evenly, away from the very start and end.
+	times := make([]float64, compareFrames)
+	for i := range times {
+		times[i] = dur * float64(i+1) / float64(compareFrames+1)
+	}
+	if err := enc.ContactSheet(ctx, ref, dist, times, sheet); err != nil {
+		return "", "", fmt.Errorf("contact sheet: %w", err)
+	}
+	length := math.Min(compareClipSec, dur)
+	if err := enc.CompareClip(ctx, ref, dist, math.Max(dur/2-length/2, 0), length, cfg.Wipe, clip); err != nil {
+		return "", "", fmt.Errorf("clip: %w", err)
+	}
+	return sheet, clip, nil
+}
+
+// comparePair finds the original and output of a converted movie: a
+// conversion awaiting review, or one in the audit file whose original is
+// still around (kept by --no-delete or for the AV1 stage).
+func comparePair(fsys vfs.FS, file string) (rootPath, ref, dist string, err error) {
+	if root, item, err := findReview(fsys, file); err == nil {
+		item.rebase(root)
+		return root, item.C.EncodeInput(), reviewFile(root, reviewID(item.Path), paths.OutputExt), nil
+	}
+	root, rec, err := locateAudit(fsys, file)
+	if err != nil {
+		return "", "", "", err
+	}
+	dist = paths.InRoot(root, rec.Output.Path)
+	ref = paths.InRoot(root, rec.Source.Path)
+	if _, err := fsys.Stat(ref); err != nil {
+		ref = paths.DeleteMePath(ref)
+		if _, err := fsys.Stat(ref); err != nil {
+			return "", "", "", fmt.Errorf("the original of %s is no longer around to compare with", file)
+		}
+	}
+	return root, ref, dist, nil
+}
+
+// Compare renders a contact sheet and comparison clip for a converted movie
+// and prints where they were saved.
+func Compare(ctx context.Context, cfg Config, file string, w io.Writer) error {
+	root, ref, dist, err := comparePair(cfg.FS, file)
+	if err != nil {
+		return err
+	}
+	cfg.RootPath = root
+	enc, err := setup(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("comparing %s with %s", ref, dist)
+	sheet, clip, err := writeComparison(ctx, cfg, enc, ref, dist)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "contact sheet: %s\nclip:          %s\n", sheet, clip)
+	return nil
+}
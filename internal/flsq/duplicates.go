@@ -0,0 +1,329 @@
+package flsq
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/scanner"
+)
+
+// Duplicates: the index already knows every movie's fingerprint, duration
+// and streams, which is enough to spot the same film twice: identical copies,
+// other rips of it, and originals kept by --no-delete next to their
+// conversion. Nothing is removed unless asked for, one file at a time.
+
+// dupFile is one member of a duplicate group.
+type dupFile struct {
+	scanner.IndexEntry
+	leftover bool   // a _deleteMe original of a converted file
+	why      string // how it relates to the file kept
+}
+
+// dupGroup is a set of probable duplicates; files[0] is the one to keep.
+type dupGroup struct {
+	title string
+	files []dupFile
+}
+
+func (g dupGroup) reclaimable() (n int64) {
+	for _, f := range g.files[1:] {
+		n += f.Size
+	}
+	return n
+}
+
+// releaseTokens end the title part of a release-style file name.
+var releaseTokens = map[string]bool{
+	"2160p": true, "1080p": true, "1080i": true, "720p": true, "576p": true, "480p": true,
+	"4k": true, "uhd": true, "hdr": true, "hdr10": true, "sdr": true,
+	"bluray": true, "bdrip": true, "brrip": true, "remux": true, "webrip": true, "webdl": true,
+	"web": true, "hdtv": true, "dvdrip": true, "dvd": true, "hdrip": true,
+	"x264": true, "x265": true, "h264": true, "h265": true, "hevc": true, "avc": true, "av1": true,
+	"xvid": true, "divx": true, "10bit": true, "8bit": true, "proper": true, "repack": true,
+}
+
+// titleKey normalises a file name to the title it names: lower case, without
+// bracketed tags, separators, or anything from the first release token on.
+// "Heat.1995.1080p.BluRay.x264-GRP.mkv" and "Heat (1995).avi" both give
+// "heat 1995".
+func titleKey(p string) string {
+	base := filepath.Base(strings.ReplaceAll(p, "\\", "/"))
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	base = strings.TrimSuffix(base, paths.DeleteMeTag)
+	base = strings.ToLower(base)
+	for _, br := range [][2]string{{"[", "]"}, {"{", "}"}} {
+		for {
+			i := strings.Index(base, br[0])
+			j := strings.Index(base, br[1])
+			if i < 0 || j < i {
+				break
+			}
+			base = base[:i] + " " + base[j+1:]
+		}
+	}
+	base = strings.ReplaceAll(base, "web-dl", "webdl")
+	words := strings.FieldsFunc(base, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	for i, w := range words {
+		if i > 0 && releaseTokens[w] {
+			words = words[:i]
+			break
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func duration(m scanner.FileMeta) float64 {
+	if m.Probe != nil && m.Probe.Duration > 0 {
+		return m.Probe.Duration
+	}
+	if m.Video != nil {
+		return m.Video.Duration
+	}
+	return 0
+}
+
+// sameRuntime reports whether two durations are close enough to be the same
+// cut of a film.
+func sameRuntime(a, b float64) bool {
+	return a > 0 && b > 0 && math.Abs(a-b) <= math.Max(30, 0.02*math.Max(a, b))
+}
+
+// quality orders files for keeping: picture size first, then video bitrate
+// weighed by how efficient the codec is. Leftover originals always rank last.
+func quality(f dupFile) (leftover bool, pixels int, bitrate float64) {
+	v := f.Meta.Video
+	if v == nil {
+		return f.leftover, 0, 0
+	}
+	return f.leftover, v.Width * v.Height, float64(v.Bitrate) * scanner.TargetBPP("h264") / scanner.TargetBPP(f.Codec)
+}
+
+func better(a, b dupFile) bool {
+	la, pa, ba := quality(a)
+	lb, pb, bb := quality(b)
+	switch {
+	case la != lb:
+		return !la
+	case pa != pb:
+		return pa > pb
+	case ba != bb:
+		return ba > bb
+	}
+	return a.Path < b.Path
+}
+
+// findDuplicates groups the indexed files of the library, plus the originals
+// kept next to converted files, into probable duplicates.
+func findDuplicates(cfg Config) []dupGroup {
+	var files []dupFile
+	byPath := make(map[string]int)
+	for _, e := range scanner.LoadIndex(cfg.FS, cfg.RootPath) {
+		if e.Codec == "X" {
+			continue
+		}
+		byPath[e.Path] = len(files)
+		files = append(files, dupFile{IndexEntry: e})
+	}
+
+	parent := make([]int, len(files))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(i, j int) { parent[find(i)] = find(j) }
+
+	// Originals kept by --no-delete, paired with their conversion.
+	moves := scanner.LoadMoves(cfg.FS, cfg.RootPath)
+	for _, row := range scanner.LoadTallyRows(cfg.FS, paths.InRoot(cfg.RootPath, paths.TallyFile)) {
+		out, ok := byPath[scanner.Moved(moves, row.OutPath)]
+		kept := paths.DeleteMePath(scanner.Moved(moves, row.OrigPath))
+		if !ok || kept == files[out].Path {
+			continue
+		}
+		if _, seen := byPath[kept]; seen {
+			continue
+		}
+		info, err := cfg.FS.Stat(kept)
+		if err != nil {
+			continue
+		}
+		byPath[kept] = len(files)
+		files = append(files, dupFile{
+			IndexEntry: scanner.IndexEntry{Path: kept, Codec: row.FromCodec, ModTime: info.ModTime(), Size: info.Size()},
+			leftover:   true,
+		})
+		parent = append(parent, len(parent))
+		union(len(files)-1, out)
+	}
+
+	byFP := make(map[string]int)
+	byTitle := make(map[string][]int)
+	for i, f := range files {
+		if fp := f.Meta.FP; fp != "" {
+			if j, ok := byFP[fp]; ok {
+				union(i, j)
+			} else {
+				byFP[fp] = i
+			}
+		}
+		if !f.leftover {
+			if t := titleKey(f.Path); t != "" {
+				byTitle[t] = append(byTitle[t], i)
+			}
+		}
+	}
+	for _, members := range byTitle {
+		for a, i := range members {
+			for _, j := range members[a+1:] {
+				if sameRuntime(duration(files[i].Meta), duration(files[j].Meta)) {
+					union(i, j)
+				}
+			}
+		}
+	}
+
+	sets := make(map[int][]dupFile)
+	for i, f := range files {
+		sets[find(i)] = append(sets[find(i)], f)
+	}
+	var groups []dupGroup
+	for _, members := range sets {
+		if len(members) < 2 {
+			continue
+		}
+		sort.Slice(members, func(i, j int) bool { return better(members[i], members[j]) })
+		keep := members[0]
+		for i := range members[1:] {
+			f := &members[i+1]
+			switch {
+			case f.leftover:
+				f.why = "original kept after conversion"
+			case f.Meta.FP != "" && f.Meta.FP == keep.Meta.FP:
+				f.why = "identical copy"
+			default:
+				f.why = "other version"
+			}
+		}
+		groups = append(groups, dupGroup{title: titleKey(keep.Path), files: members})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if ri, rj := groups[i].reclaimable(), groups[j].reclaimable(); ri != rj {
+			return ri > rj
+		}
+		return groups[i].title < groups[j].title
+	})
+	return groups
+}
+
+// describe is a one-line summary of a file's video.
+func describe(f dupFile) string {
+	v := f.Meta.Video
+	codec := f.Codec
+	if codec == "flicksqueeze" {
+		codec = "av1"
+	}
+	if v == nil || v.Width == 0 {
+		return fmt.Sprintf("%-9s %-5s %9s", "?", codec, "")
+	}
+	return fmt.Sprintf("%-9s %-5s %4.1f Mb/s", fmt.Sprintf("%dx%d", v.Width, v.Height), codec, float64(v.Bitrate)/1e6)
+}
+
+// unchanged checks that f is still the file the index describes.
+func unchanged(cfg Config, f dupFile) error {
+	info, err := cfg.FS.Stat(f.Path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != f.Size || !info.ModTime().Truncate(time.Second).Equal(f.ModTime.Truncate(time.Second)) {
+		return fmt.Errorf("%s changed since it was indexed (run a scan first)", f.Path)
+	}
+	return nil
+}
+
+// stillDuplicate checks, right before drop is deleted, that both it and the
+// copy being kept are still the files the index describes, and that an
+// identical copy still is one.
+func stillDuplicate(cfg Config, keep, drop dupFile) error {
+	if err := unchanged(cfg, keep); err != nil {
+		return fmt.Errorf("the copy to keep: %w", err)
+	}
+	if err := unchanged(cfg, drop); err != nil {
+		return err
+	}
+	if drop.why == "identical copy" {
+		fp := scanner.Fingerprint(cfg.FS, keep.Path, keep.Size)
+		if fp == "" || fp != scanner.Fingerprint(cfg.FS, drop.Path, drop.Size) {
+			return fmt.Errorf("%s no longer matches %s", drop.Path, keep.Path)
+		}
+	}
+	return nil
+}
+
+// Duplicates reports probable duplicate movies in the library, best copy
+// first, with the space removing the others would free. With cfg.Remove it
+// then asks, file by file, whether to delete each lesser copy; answers are
+// read from in.
+func Duplicates(cfg Config, w io.Writer, in io.Reader) error {
+	groups := findDuplicates(cfg)
+	if len(groups) == 0 {
+		fmt.Fprintln(w, "no probable duplicates in the index (run a scan first to index the library)")
+		return nil
+	}
+	var total int64
+	for i, g := range groups {
+		total += g.reclaimable()
+		fmt.Fprintf(w, "%3d. %s: %d files, %s reclaimable\n", i+1, g.title, len(g.files), scanner.HumanSize(g.reclaimable()))
+		for j, f := range g.files {
+			verdict, why := "keep", ""
+			if j > 0 {
+				verdict, why = "drop", " ("+f.why+")"
+			}
+			fmt.Fprintf(w, "     %s %s %9s  %s%s\n", verdict, describe(f), scanner.HumanSize(f.Size), f.Path, why)
+		}
+	}
+	fmt.Fprintf(w, "\n%d groups, %s reclaimable\n", len(groups), scanner.HumanSize(total))
+	if !cfg.Remove {
+		return nil
+	}
+
+	answers := bufio.NewScanner(in)
+	for _, g := range groups {
+		for _, f := range g.files[1:] {
+			fmt.Fprintf(w, "delete %s (%s, %s; keeping %s)? [y/N/q] ", f.Path, scanner.HumanSize(f.Size), f.why, g.files[0].Path)
+			if !answers.Scan() {
+				fmt.Fprintln(w)
+				return answers.Err()
+			}
+			switch strings.ToLower(strings.TrimSpace(answers.Text())) {
+			case "y", "yes":
+				if err := stillDuplicate(cfg, g.files[0], f); err != nil {
+					fmt.Fprintf(w, "not deleted: %v\n", err)
+					continue
+				}
+				if err := cfg.FS.Remove(f.Path); err != nil {
+					fmt.Fprintf(w, "cannot delete: %v\n", err)
+					continue
+				}
+				log.Printf("duplicates: deleted %s (kept %s)", f.Path, g.files[0].Path)
+			case "q", "quit":
+				return nil
+			}
+		}
+	}
+	return nil
+}
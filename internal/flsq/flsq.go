@@ -3,8 +3,12 @@ package flsq
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
 	"log"
 	"math"
 	"os"
@@ -15,6 +19,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/snadrus/flicksqueeze/internal/config"
 	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
 	"github.com/snadrus/flicksqueeze/internal/paths"
 	"github.com/snadrus/flicksqueeze/internal/scanner"
@@ -22,8 +27,13 @@ import (
 	"github.com/snadrus/flicksqueeze/internal/vfs"
 )
 
+// errWontShrink aborts an encode whose projected output is not smaller than the input.
+var errWontShrink = errors.New("projected output not smaller than input, aborted early")
+
 const (
+	earlyAbortAfter = 0.15             // fraction encoded before the size projection is trusted
 	idleRescanSleep = 15 * time.Minute // when scan finds 0 candidates, sleep then rescan (no long pause when list had work)
+	indexLockRetry  = time.Minute      // while an index command holds the index
 	baselineGHz     = 2.5
 	baseRateH       = 3.0
 	safetyMult      = 5.0
@@ -36,8 +46,16 @@ type Config struct {
 	NoDelete    bool
 	Verbose     bool // log why each file is skipped during scan
 	FS          vfs.FS
+	Library     config.Library         // per-library settings from the config file
+	Checks      validator.Chain        // validation chain built from Library
 	UploadQueue chan<- remoteUploadJob // when set, remote encodes queue uploads instead of blocking
-	UploadWg    *sync.WaitGroup       // incremented per queued upload; wait before exit
+	UploadWg    *sync.WaitGroup        // incremented per queued upload; wait before exit
+	Version     string                 // flicksqueeze build, for audit records
+	Encoders    map[string]string      // ffmpeg/ffprobe version lines, filled in by Run
+	Wipe        bool                   // comparison clips wipe from source to output instead of side by side
+	Remove      bool                   // duplicates: offer to delete the lesser copies
+	JSON        bool                   // index export: JSON lines instead of CSV
+	Paths       []string               // index rebuild: the files and folders to probe again
 }
 
 // remoteUploadJob is sent to the upload worker after a remote encode completes.
@@ -46,30 +64,60 @@ type remoteUploadJob struct {
 	RemoteTmpPath string
 	OutPath       string
 	TmpDir        string
-	EncType       string
+	Conv          conversion
 	C             scanner.Candidate
 	Cfg           Config
 	Enc           *ffmpeglib.Encoder
 	St            *status
 }
 
+// conversion describes how an output was produced, for the tally.
+type conversion struct {
+	EncType string // "av1" or "hevc"
+	Mode    string // rate control: config.ModeCRF/VBR/Hybrid, or config.ModeHW for hevc
+
+	// Retained is where an HEVC pre-pass keeps the original until the AV1 stage.
+	Retained string
+
+	// Pred is the preflight prediction for this encode, if one was made.
+	Pred *scanner.Prediction
+
+	// Dropped is what the encode intentionally left out, for validation.
+	Dropped validator.Dropped
+
+	// Validation is the outcome of each validation check.
+	Validation validator.Result
+
+	// For the audit record: ffprobe reports of both sides, the ffmpeg
+	// commands run and how long encoding took.
+	SourceProbe json.RawMessage
+	OutputProbe json.RawMessage
+	Commands    *ffmpeglib.CommandLog
+	Wall        time.Duration
+
+	// OutputSHA256 is the output's checksum, taken during upload in remote
+	// mode and otherwise when the conversion finishes.
+	OutputSHA256 string
+}
+
 // status tracks what the converter is doing so the interactive console
 // can report it on demand.
 type status struct {
-	mu          sync.Mutex
+	mu           sync.Mutex
+	review       bool // console offers the review keys
 	sessionStart time.Time
-	file        string
-	size        int64
-	codec       string
-	encType     string
-	startedAt   time.Time
-	ffmpegTime  string // latest time= from ffmpeg progress
-	ffmpegSpd   string // latest speed= from ffmpeg progress
-	filesTotal  int
-	bytesSaved  int64
-}
-
-func (s *status) startEncode(path, codec, encType string, size int64) {
+	file         string
+	size         int64
+	codec        string
+	encType      string
+	startedAt    time.Time
+	duration     time.Duration          // input duration, 0 if unknown
+	progress     ffmpeglib.ProgressLine // latest ffmpeg progress block
+	filesTotal   int
+	bytesSaved   int64
+}
+
+func (s *status) startEncode(path, codec, encType string, size int64, duration time.Duration) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.file = path
@@ -77,22 +125,47 @@ func (s *status) startEncode(path, codec, encType string, size int64) {
 	s.codec = codec
 	s.encType = encType
 	s.startedAt = time.Now()
-	s.ffmpegTime = ""
-	s.ffmpegSpd = ""
+	s.duration = duration
+	s.progress = ffmpeglib.ProgressLine{}
 }
 
-func (s *status) updateProgress(line string) {
-	if !strings.Contains(line, "time=") {
-		return
-	}
+func (s *status) updateProgress(p ffmpeglib.ProgressLine) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if t := extractField(line, "time="); t != "" {
-		s.ffmpegTime = t
+	s.progress = p
+}
+
+// estimate derives completion, time remaining and final output size from
+// the latest progress block. ok is false until there is enough to go on.
+func (s *status) estimate() (frac float64, eta time.Duration, projected int64, ok bool) {
+	p := s.progress
+	if s.duration <= 0 || p.OutTime <= 0 {
+		return 0, 0, 0, false
 	}
-	if sp := extractField(line, "speed="); sp != "" {
-		s.ffmpegSpd = sp
+	frac = math.Min(float64(p.OutTime)/float64(s.duration), 1)
+	remaining := s.duration - p.OutTime
+	if p.Speed > 0 {
+		eta = time.Duration(float64(remaining) / p.Speed)
+	} else {
+		elapsed := time.Since(s.startedAt)
+		eta = time.Duration(float64(elapsed) * (1 - frac) / frac)
+	}
+	if p.TotalSize > 0 {
+		projected = int64(float64(p.TotalSize) / frac)
+	}
+	return frac, eta, projected, true
+}
+
+// projectedSize returns the estimated final output size once at least
+// minFrac of the input has been encoded, else 0.
+func (s *status) projectedSize(minFrac float64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	frac, _, projected, ok := s.estimate()
+	if !ok || frac < minFrac {
+		return 0
 	}
+	return projected
 }
 
 func (s *status) finishEncode(saved int64) {
@@ -113,8 +186,18 @@ func (s *status) print() {
 		fmt.Fprintf(os.Stderr, "  encoding [%s]: %s\n", s.encType, filepath.Base(s.file))
 		fmt.Fprintf(os.Stderr, "  codec: %s, size: %s, elapsed: %v\n",
 			s.codec, scanner.HumanSize(s.size), elapsed)
-		if s.ffmpegTime != "" {
-			fmt.Fprintf(os.Stderr, "  progress: time=%s speed=%s\n", s.ffmpegTime, s.ffmpegSpd)
+		if frac, eta, projected, ok := s.estimate(); ok {
+			fmt.Fprintf(os.Stderr, "  progress: %.1f%% (%v of %v) speed=%.2fx fps=%.1f\n",
+				frac*100, s.progress.OutTime.Round(time.Second), s.duration.Round(time.Second),
+				s.progress.Speed, s.progress.FPS)
+			fmt.Fprintf(os.Stderr, "  eta: %v", eta.Round(time.Minute))
+			if projected > 0 {
+				fmt.Fprintf(os.Stderr, ", projected size: %s (%.0f%% of input)",
+					scanner.HumanSize(projected), float64(projected)/float64(s.size)*100)
+			}
+			fmt.Fprintln(os.Stderr)
+		} else if s.progress.Frame > 0 {
+			fmt.Fprintf(os.Stderr, "  progress: frame=%d fps=%.1f\n", s.progress.Frame, s.progress.FPS)
 		}
 	} else {
 		fmt.Fprintln(os.Stderr, "  idle (scanning or waiting)")
@@ -129,23 +212,17 @@ func (s *status) print() {
 	fmt.Fprintln(os.Stderr, "───────────────────────────")
 	fmt.Fprintln(os.Stderr, "  [q + Enter] quit after current encode")
 	fmt.Fprintln(os.Stderr, "  [Enter]     refresh status")
-	fmt.Fprintln(os.Stderr, "")
-}
-
-func extractField(line, key string) string {
-	i := strings.Index(line, key)
-	if i < 0 {
-		return ""
+	fmt.Fprintln(os.Stderr, "  [p path]    pin a file or folder to go first (p: list, u path: unpin)")
+	if s.review {
+		fmt.Fprintln(os.Stderr, "  [r + Enter] list conversions awaiting review")
+		fmt.Fprintln(os.Stderr, "  [a N/x N]   approve / reject review N")
 	}
-	val := line[i+len(key):]
-	if j := strings.IndexByte(val, ' '); j >= 0 {
-		val = val[:j]
-	}
-	return strings.TrimSpace(val)
+	fmt.Fprintln(os.Stderr, "")
 }
 
-// startConsole reads lines from stdin. Enter shows status, "q" triggers quit.
-func startConsole(st *status) <-chan struct{} {
+// startConsole reads lines from stdin. Enter shows status, "q" triggers quit,
+// and the review keys act on conversions awaiting review.
+func startConsole(cfg Config, st *status) <-chan struct{} {
 	quitCh := make(chan struct{})
 	go func() {
 		r := bufio.NewReader(os.Stdin)
@@ -159,23 +236,74 @@ func startConsole(st *status) <-chan struct{} {
 				close(quitCh)
 				return
 			}
+			if consoleReview(cfg, os.Stderr, line) || consolePins(cfg, os.Stderr, line) {
+				continue
+			}
 			st.print()
 		}
 	}()
 	return quitCh
 }
 
-func Run(ctx context.Context, cfg Config) error {
+// setup returns an encoder that probes where the library lives, and loads
+// the library settings into cfg.
+func setup(ctx context.Context, cfg *Config) (*ffmpeglib.Encoder, error) {
 	enc := ffmpeglib.New()
 	if cfg.FS.IsRemote() {
 		enc.ProbeExec = cfg.FS.Exec
+		enc.AnalyzeExec = cfg.FS.Exec
 	}
 	if err := enc.EnsureAvailable(ctx); err != nil {
+		return nil, err
+	}
+
+	lib, err := config.Load(cfg.FS, cfg.RootPath)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Library = lib
+	if cfg.Checks, err = validator.FromConfig(lib); err != nil {
+		return nil, fmt.Errorf("%s: %w", paths.ConfigFile, err)
+	}
+	return enc, nil
+}
+
+// remoteProbeBatch is how many files one ffprobe command covers when
+// scanning over SSH.
+const remoteProbeBatch = 16
+
+func scanOptions(cfg Config, hw ffmpeglib.HWCaps) scanner.Options {
+	opts := scanner.Options{
+		Verbose:       cfg.Verbose,
+		Mode:          cfg.Library.AV1Mode,
+		FolderWeights: cfg.Library.FolderWeights,
+		ProbeWorkers:  cfg.Library.ProbeWorkersLocal,
+		WarmUp:        cfg.Library.ScanWarmup,
+		Archive:       cfg.Library.HEVCArchive,
+	}
+	if hw.UseHEVCFirst() {
+		opts.HEVCFirst = hevcFirstCodecs
+	}
+	if cfg.FS.IsRemote() {
+		opts.ProbeWorkers = cfg.Library.ProbeWorkersRemote
+		opts.ProbeBatch = remoteProbeBatch
+	}
+	if cfg.Library.Preflight {
+		opts.MinSavings = cfg.Library.PreflightMinSavings
+	}
+	return opts
+}
+
+func Run(ctx context.Context, cfg Config) error {
+	enc, err := setup(ctx, &cfg)
+	if err != nil {
 		return err
 	}
 
-	st := status{sessionStart: time.Now()}
-	quitCh := startConsole(&st)
+	cfg.Encoders = enc.Versions(ctx)
+
+	st := status{sessionStart: time.Now(), review: cfg.Library.Review}
+	quitCh := startConsole(cfg, &st)
 
 	// scanCtx is cancelled when the user asks to quit, stopping the scanner
 	// and the candidate loop. The parent ctx stays live so the in-flight
@@ -203,12 +331,35 @@ func Run(ctx context.Context, cfg Config) error {
 	}
 	if cfg.FS.IsRemote() {
 		log.Println("remote mode: files will be downloaded for local encoding (upload overlaps with next download)")
+		pruneWorkDirs()
+	}
+	if mae, n := scanner.PredictionAccuracy(cfg.FS, paths.InRoot(cfg.RootPath, paths.TallyFile)); n > 0 {
+		log.Printf("preflight accuracy: predictions off by %.1f points of savings on average (%d encodes)", mae*100, n)
 	}
 	log.Println("press Enter for status, q+Enter to quit")
 
+	// The queue of the last completed scan lets encoding start right away;
+	// the scan running alongside replaces it once its walk is done.
+	queue := scanner.OpenQueue(cfg.FS, cfg.RootPath, cfg.Library.FolderWeights)
+	if n := queue.Len(); n > 0 {
+		log.Printf("resuming %d queued candidates while the library is rescanned", n)
+	}
+
 	for {
+		before := queue.Candidates()
 		ch := make(chan scanner.Candidate)
-		go scanner.Scan(scanCtx, cfg.FS, enc, cfg.RootPath, ch, cfg.Verbose)
+		opts := scanOptions(cfg, hw)
+		opts.Queue = queue
+		release, err := lockIndex(cfg)
+		for err != nil {
+			log.Printf("scan: %v; retrying in %v", err, indexLockRetry)
+			if !sleepCtx(scanCtx, indexLockRetry) {
+				return nil
+			}
+			release, err = lockIndex(cfg)
+		}
+		opts.Indexed = release
+		go scanner.Scan(scanCtx, cfg.FS, enc, cfg.RootPath, ch, opts)
 		log.Println("scanning for conversion candidates...")
 
 		var uploadChan chan remoteUploadJob
@@ -221,7 +372,8 @@ func Run(ctx context.Context, cfg Config) error {
 		}
 
 		processed := 0
-		for c := range ch {
+		next := nextCandidate(ch, queue)
+		for c, ok := next(); ok; c, ok = next() {
 			if scanCtx.Err() != nil {
 				for range ch {
 				}
@@ -233,9 +385,13 @@ func Run(ctx context.Context, cfg Config) error {
 			}
 			log.Printf("candidate: [%s] %s (%s, codec=%s)",
 				scanner.HumanSize(c.Size), c.Path, fmtWaste(c.WasteScore), c.Codec)
+			if c.RankWhy != "" {
+				log.Printf("candidate: %s", c.RankWhy)
+			}
 			if processCandidate(ctx, cfg, enc, c, hw, &st) {
 				processed++
 			}
+			queue.Done(c.Path)
 			if scanCtx.Err() != nil {
 				for range ch {
 				}
@@ -255,6 +411,9 @@ func Run(ctx context.Context, cfg Config) error {
 		if scanCtx.Err() != nil {
 			return nil
 		}
+		if cfg.FS.IsRemote() {
+			dropWorkDirs(cfg.FS, before, queue)
+		}
 
 		if processed == 0 {
 			log.Println("no conversion candidates found, rescanning in", idleRescanSleep)
@@ -265,6 +424,47 @@ func Run(ctx context.Context, cfg Config) error {
 	}
 }
 
+// nextCandidate returns an iterator over the candidates of a scan and the
+// stored queue: the scan's when it has one ready, the queue's otherwise. A
+// file is handed out once per scan, whichever of them names it again.
+func nextCandidate(ch <-chan scanner.Candidate, queue *scanner.Queue) func() (scanner.Candidate, bool) {
+	seen := make(map[string]bool)
+	return func() (scanner.Candidate, bool) {
+		for {
+			var c scanner.Candidate
+			ok := false
+			if ch != nil {
+				select {
+				case c, ok = <-ch:
+					if !ok {
+						ch = nil
+						continue
+					}
+				default:
+				}
+			}
+			if !ok {
+				c, ok = queue.Next()
+			}
+			if !ok && ch != nil {
+				if c, ok = <-ch; !ok {
+					ch = nil
+					continue
+				}
+			}
+			if !ok {
+				return c, false
+			}
+			if seen[c.Path] {
+				queue.Done(c.Path)
+				continue
+			}
+			seen[c.Path] = true
+			return c, true
+		}
+	}
+}
+
 var hevcFirstCodecs = map[string]bool{
 	"h264": true, "mpeg4": true, "mpeg2video": true, "mpeg1video": true,
 	"msmpeg4v1": true, "msmpeg4v2": true, "msmpeg4v3": true,
@@ -293,7 +493,17 @@ func processCandidate(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, c
 		return false
 	}
 
+	// --- AV1 stage of an HEVC pre-pass: encode from the retained original ---
+	if c.Source != "" {
+		if _, err := fsys.Stat(c.Source); err != nil {
+			log.Printf("retained original %s is gone, encoding from %s", c.Source, c.Path)
+			c.Source = ""
+		}
+	}
+	input := c.EncodeInput()
+
 	outPath := paths.OutputPath(c.Path)
+	retained := retainedPath(cfg, c.Path)
 
 	// --- collision / restart detection ---
 	if _, err := fsys.Stat(outPath); err == nil {
@@ -302,14 +512,21 @@ func processCandidate(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, c
 			log.Printf("skipping %s: output %s already exists (not ours)", c.Path, outPath)
 			return false
 		}
-		if err := validator.Validate(ctx, fsys, enc, c.Path, outPath, c.Size); err == nil {
+		// Whether the earlier run dropped subtitles is unknown, so allow it.
+		// The mode it encoded with is tagged on the output; outputs from
+		// before the tag existed train no mode's savings.
+		conv := conversion{EncType: "av1", Mode: scanner.TallyModeUnknown, Pred: c.Meta.Pred,
+			Dropped: validator.Dropped{Subtitles: true, ExtraVideo: true}}
+		if tags, err := enc.FormatTags(ctx, outPath, paths.ModeTag); err == nil && tags[paths.ModeTag] != "" {
+			conv.Mode = tags[paths.ModeTag]
+		}
+		if comment == paths.HEVCMetaComment {
+			conv = conversion{EncType: "hevc", Mode: config.ModeHW, Retained: retained,
+				Dropped: validator.Dropped{Subtitles: true}}
+		}
+		if err := validate(ctx, cfg, enc, input, outPath, c.EncodeSize(), &conv); err == nil {
 			log.Printf("restart recovery: %s already converted, finishing up", c.Path)
-			comment, _ := enc.Comment(ctx, outPath)
-			encType := "av1"
-			if comment == paths.HEVCMetaComment {
-				encType = "hevc"
-			}
-			finishConversion(fsys, c, outPath, cfg.RootPath, cfg.NoDelete, encType, st)
+			finishConversion(cfg, c, outPath, conv, st)
 			return true
 		}
 		log.Printf("stale output %s from previous failed run, removing", outPath)
@@ -317,35 +534,70 @@ func processCandidate(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, c
 	}
 
 	// --- choose encoder ---
-	useHEVC := hw.UseHEVCFirst() && hevcFirstCodecs[strings.ToLower(c.Codec)]
-	encType := "av1"
+	useHEVC := c.Stage == "" && hw.UseHEVCFirst() && hevcFirstCodecs[strings.ToLower(c.Codec)]
+	conv := conversion{EncType: "av1", Mode: cfg.Library.AV1Mode}
 	if useHEVC {
-		encType = "hevc"
+		conv = conversion{EncType: "hevc", Mode: config.ModeHW, Retained: retained}
+	}
+	var duration time.Duration
+	if secs, err := enc.DurationSeconds(ctx, input); err == nil {
+		duration = time.Duration(secs * float64(time.Second))
 	}
-	st.startEncode(c.Path, c.Codec, encType, c.Size)
+	st.startEncode(c.Path, c.Codec, conv.EncType, c.Size, duration)
+
+	// encCtx is cancelled with errWontShrink when early abort is enabled and
+	// the output is on course to be no smaller than the input.
+	conv.Commands = &ffmpeglib.CommandLog{}
+	encCtx, cancelEnc := context.WithCancelCause(ffmpeglib.WithCommandLog(ctx, conv.Commands))
+	defer cancelEnc(nil)
 	progress := func(p ffmpeglib.ProgressLine) {
-		st.updateProgress(p.Raw)
+		st.updateProgress(p)
+		if !cfg.Library.EarlyAbort {
+			return
+		}
+		if projected := st.projectedSize(earlyAbortAfter); projected >= c.EncodeSize() {
+			cancelEnc(errWontShrink)
+		}
 	}
 
 	var queuedJob *remoteUploadJob
 	if fsys.IsRemote() && cfg.UploadQueue != nil {
-		queuedJob = &remoteUploadJob{C: c, Cfg: cfg, Enc: enc, St: st, EncType: encType}
+		queuedJob = &remoteUploadJob{C: c, Cfg: cfg, Enc: enc, St: st}
 	}
+	manifestPath := paths.SegmentManifest(c.Path)
+	gate := preflightGate(encCtx, cfg, enc, c, &conv)
 	if fsys.IsRemote() {
-		err = encodeRemote(ctx, cfg, enc, c, outPath, useHEVC, hw, timeout, progress, encType, queuedJob)
+		err = encodeRemote(encCtx, cfg, enc, c, outPath, useHEVC, hw, timeout, gate, progress, &conv, queuedJob)
 	} else {
 		if useHEVC {
-			err = encodeHEVC(ctx, enc, c.Path, outPath, hw, timeout, progress)
+			err = encodeHEVC(encCtx, enc, c.Path, outPath, hw, hevcMeta(c, retained), timeout, progress, &conv)
 		} else {
-			err = encodeAV1(ctx, enc, c.Path, outPath, timeout, progress)
+			err = encodeAV1(encCtx, enc, input, outPath, manifestPath, cfg.Library, timeout, gate, progress, &conv)
 		}
 	}
 
+	if errors.Is(err, errNotWorthIt) {
+		log.Printf("skipping %s: %v", c.Path, err)
+		return false
+	}
 	if err != nil {
+		if errors.Is(context.Cause(encCtx), errWontShrink) {
+			err = errWontShrink
+		}
 		log.Printf("encode failed for %s: %v", c.Path, err)
 		_ = fsys.Remove(outPath)
 		if ctx.Err() == nil {
-			scanner.MarkFailed(fsys, cfg.RootPath, c.Path)
+			// Interrupted encodes keep their segments for resuming; real
+			// failures start over.
+			if !fsys.IsRemote() {
+				ffmpeglib.DiscardSegments(outPath, manifestPath)
+			}
+			scanner.MarkFailed(fsys, cfg.RootPath, c.Path, "encode: "+err.Error())
+			var outSize int64
+			if errors.Is(err, errWontShrink) {
+				outSize = st.projectedSize(earlyAbortAfter)
+			}
+			recordFailure(cfg, c, conv, outSize)
 		}
 		return false
 	}
@@ -358,53 +610,68 @@ func processCandidate(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, c
 	}
 
 	// --- validate (probes run where files live) ---
-	if err := validator.Validate(ctx, fsys, enc, c.Path, outPath, c.Size); err != nil {
+	if err := validate(ctx, cfg, enc, input, outPath, c.EncodeSize(), &conv); err != nil {
 		log.Printf("validation failed for %s: %v", c.Path, err)
+		outSize := sizeOf(fsys, outPath)
 		_ = fsys.Remove(outPath)
 		if ctx.Err() == nil {
-			scanner.MarkFailed(fsys, cfg.RootPath, c.Path)
+			scanner.MarkFailed(fsys, cfg.RootPath, c.Path, "validation: "+err.Error())
+			recordFailure(cfg, c, conv, outSize)
 		}
 		return false
 	}
 
-	finishConversion(fsys, c, outPath, cfg.RootPath, cfg.NoDelete, encType, st)
+	finishConversion(cfg, c, outPath, conv, st)
 	return true
 }
 
 // encodeRemote downloads the source, encodes locally, and optionally uploads (sync) or fills job for async upload.
-// If job is non-nil, a unique tmpDir is used and the worker must remove it after uploading; upload is not done here.
-func encodeRemote(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, c scanner.Candidate, outPath string, useHEVC bool, hw ffmpeglib.HWCaps, timeout time.Duration, progress func(ffmpeglib.ProgressLine), encType string, job *remoteUploadJob) error {
-	tmpDir := filepath.Join(os.TempDir(), "flicksqueeze-work")
-	if job != nil {
-		tmpDir = filepath.Join(os.TempDir(), "flicksqueeze-work-"+strconv.FormatInt(time.Now().UnixNano(), 10))
-	} else {
-		os.RemoveAll(tmpDir)
-	}
+// The work dir is derived from the remote path so an interrupted encode can resume its download and segments.
+// If job is non-nil, the worker must remove the work dir after uploading; upload is not done here.
+func encodeRemote(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, c scanner.Candidate, outPath string, useHEVC bool, hw ffmpeglib.HWCaps, timeout time.Duration, gate func(string, ffmpeglib.AV1Options) error, progress func(ffmpeglib.ProgressLine), conv *conversion, job *remoteUploadJob) (err error) {
+	input, inSize := c.EncodeInput(), c.EncodeSize()
+	tmpDir := remoteWorkDir(input)
 	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
 		return err
 	}
-	if job == nil {
-		defer os.RemoveAll(tmpDir)
-	}
+	defer func() {
+		// Keep the work dir when interrupted so the next run can resume.
+		if (err != nil && !interrupted(ctx)) || (err == nil && job == nil) {
+			os.RemoveAll(tmpDir)
+		}
+	}()
 
-	localIn := filepath.Join(tmpDir, "input"+filepath.Ext(c.Path))
+	localIn := filepath.Join(tmpDir, "input"+filepath.Ext(input))
 	localOut := filepath.Join(tmpDir, "output"+paths.OutputExt)
+	manifestPath := paths.SegmentManifest(localIn)
 
-	log.Printf("downloading %s...", c.Path)
-	if err := cfg.FS.CopyToLocal(c.Path, localIn); err != nil {
-		return fmt.Errorf("download failed: %w", err)
+	// The download takes the remote file's modification time, which the
+	// segment manifest records, so a resume notices a replaced source.
+	remote, err := cfg.FS.Stat(input)
+	if err != nil {
+		return err
+	}
+	if fi, statErr := os.Stat(localIn); statErr == nil && fi.Size() == inSize && fi.Size() == remote.Size() &&
+		fi.ModTime().Equal(remote.ModTime()) && !useHEVC && fileExists(manifestPath) {
+		log.Printf("resuming %s from earlier download", input)
+	} else {
+		log.Printf("downloading %s...", input)
+		if _, err := cfg.FS.CopyToLocal(input, localIn); err != nil {
+			return fmt.Errorf("download failed: %w", err)
+		}
+		if err := os.Chtimes(localIn, remote.ModTime(), remote.ModTime()); err != nil {
+			return err
+		}
 	}
 
-	var err error
+	// The input is now local, so probe it here rather than over SSH.
+	local := enc.Local()
 	if useHEVC {
-		err = encodeHEVC(ctx, enc, localIn, localOut, hw, timeout, progress)
+		err = encodeHEVC(ctx, local, localIn, localOut, hw, hevcMeta(c, conv.Retained), timeout, progress, conv)
 	} else {
-		err = encodeAV1(ctx, enc, localIn, localOut, timeout, progress)
+		err = encodeAV1(ctx, local, localIn, localOut, manifestPath, cfg.Library, timeout, gate, progress, conv)
 	}
 	if err != nil {
-		if job != nil {
-			os.RemoveAll(tmpDir)
-		}
 		return err
 	}
 
@@ -416,14 +683,16 @@ func encodeRemote(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, c sca
 		job.RemoteTmpPath = remoteTmpPath
 		job.OutPath = outPath
 		job.TmpDir = tmpDir
-		job.EncType = encType
+		job.Conv = *conv
 		return nil
 	}
 
 	log.Printf("uploading result to %s...", remoteTmpPath)
-	if err := cfg.FS.CopyFromLocal(localOut, remoteTmpPath); err != nil {
+	sum, err := cfg.FS.CopyFromLocal(localOut, remoteTmpPath)
+	if err != nil {
 		return fmt.Errorf("upload failed: %w", err)
 	}
+	conv.OutputSHA256 = sum
 	if err := cfg.FS.Rename(remoteTmpPath, outPath); err != nil {
 		_ = cfg.FS.Remove(remoteTmpPath)
 		return fmt.Errorf("remote rename failed: %w", err)
@@ -431,6 +700,90 @@ func encodeRemote(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, c sca
 	return nil
 }
 
+// interrupted reports whether ctx was cancelled by shutdown rather than by
+// an early abort, i.e. whether partial work is worth keeping.
+func interrupted(ctx context.Context) bool {
+	return ctx.Err() != nil && !errors.Is(context.Cause(ctx), errWontShrink)
+}
+
+// remoteWorkDir is the local scratch directory for encoding a remote file.
+// It lives in the user cache dir (not /tmp, which may be wiped on reboot).
+func remoteWorkDir(remotePath string) string {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(remotePath))
+	return filepath.Join(base, "flicksqueeze", fmt.Sprintf("work-%016x", h.Sum64()))
+}
+
+// workDirMaxAge is how long a work dir left by an interrupted remote encode
+// waits for the encode to be resumed.
+const workDirMaxAge = 7 * 24 * time.Hour
+
+// pruneWorkDirs removes remote work dirs nothing was written to for
+// workDirMaxAge.
+func pruneWorkDirs() {
+	base := filepath.Dir(remoteWorkDir(""))
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		dir := filepath.Join(base, e.Name())
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), "work-") || time.Since(lastWrite(dir)) < workDirMaxAge {
+			continue
+		}
+		log.Printf("removing abandoned work dir %s", dir)
+		os.RemoveAll(dir)
+	}
+}
+
+// lastWrite is the latest modification time of dir or anything in it.
+func lastWrite(dir string) time.Time {
+	var latest time.Time
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
+
+// dropWorkDirs removes the work dirs of candidates that were queued in
+// before but have left the queue unconverted, unless another instance has
+// locked them for its own encode.
+func dropWorkDirs(fsys vfs.FS, before []scanner.Candidate, queue *scanner.Queue) {
+	queued := make(map[string]bool)
+	for _, c := range queue.Candidates() {
+		queued[c.Path] = true
+	}
+	for _, c := range before {
+		if queued[c.Path] {
+			continue
+		}
+		dir := remoteWorkDir(c.EncodeInput())
+		if !fileExists(dir) {
+			continue
+		}
+		if _, err := fsys.Stat(c.Path + paths.LockSuffix); err == nil {
+			continue
+		}
+		log.Printf("%s left the queue, removing its work dir", c.Path)
+		os.RemoveAll(dir)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
 // runUploadWorker consumes upload jobs and runs upload, validate, and finishConversion.
 // Allows the next candidate to start downloading/encoding while the previous upload runs.
 func runUploadWorker(ch <-chan remoteUploadJob, wg *sync.WaitGroup) {
@@ -439,44 +792,106 @@ func runUploadWorker(ch <-chan remoteUploadJob, wg *sync.WaitGroup) {
 			defer wg.Done()
 			ctx := context.Background()
 			log.Printf("uploading result to %s...", job.RemoteTmpPath)
-			if err := job.Cfg.FS.CopyFromLocal(job.LocalOut, job.RemoteTmpPath); err != nil {
+			sum, err := job.Cfg.FS.CopyFromLocal(job.LocalOut, job.RemoteTmpPath)
+			if err != nil {
 				log.Printf("upload failed for %s: %v", job.C.Path, err)
 				_ = job.Cfg.FS.Remove(job.OutPath)
-				scanner.MarkFailed(job.Cfg.FS, job.Cfg.RootPath, job.C.Path)
+				scanner.MarkFailed(job.Cfg.FS, job.Cfg.RootPath, job.C.Path, "upload: "+err.Error())
 				os.RemoveAll(job.TmpDir)
 				return
 			}
 			if err := job.Cfg.FS.Rename(job.RemoteTmpPath, job.OutPath); err != nil {
 				_ = job.Cfg.FS.Remove(job.RemoteTmpPath)
 				log.Printf("remote rename failed for %s: %v", job.C.Path, err)
-				scanner.MarkFailed(job.Cfg.FS, job.Cfg.RootPath, job.C.Path)
+				scanner.MarkFailed(job.Cfg.FS, job.Cfg.RootPath, job.C.Path, "upload: "+err.Error())
 				os.RemoveAll(job.TmpDir)
 				return
 			}
 			os.RemoveAll(job.TmpDir)
-			if err := validator.Validate(ctx, job.Cfg.FS, job.Enc, job.C.Path, job.OutPath, job.C.Size); err != nil {
+			job.Conv.OutputSHA256 = sum
+			if err := validate(ctx, job.Cfg, job.Enc, job.C.EncodeInput(), job.OutPath, job.C.EncodeSize(), &job.Conv); err != nil {
 				log.Printf("validation failed for %s: %v", job.C.Path, err)
+				outSize := sizeOf(job.Cfg.FS, job.OutPath)
 				_ = job.Cfg.FS.Remove(job.OutPath)
-				scanner.MarkFailed(job.Cfg.FS, job.Cfg.RootPath, job.C.Path)
+				scanner.MarkFailed(job.Cfg.FS, job.Cfg.RootPath, job.C.Path, "validation: "+err.Error())
+				recordFailure(job.Cfg, job.C, job.Conv, outSize)
 				return
 			}
-			finishConversion(job.Cfg.FS, job.C, job.OutPath, job.Cfg.RootPath, job.Cfg.NoDelete, job.EncType, job.St)
+			finishConversion(job.Cfg, job.C, job.OutPath, job.Conv, job.St)
 		}()
 	}
 }
 
-func encodeHEVC(ctx context.Context, enc *ffmpeglib.Encoder, inPath, outPath string, hw ffmpeglib.HWCaps, timeout time.Duration, progress func(ffmpeglib.ProgressLine)) error {
+// validate runs the library's validation chain on an encode and records the
+// result in conv.
+func validate(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, input, outPath string, inSize int64, conv *conversion) error {
+	res, err := cfg.Checks.Run(ctx, validator.Subject{
+		FS:         cfg.FS,
+		Enc:        enc,
+		InputPath:  input,
+		OutputPath: outPath,
+		InputSize:  inSize,
+		Dropped:    conv.Dropped,
+	})
+	conv.Validation = res
+	if len(res.Checks) > 0 {
+		log.Printf("validation: %s", res)
+	}
+	if err != nil {
+		return err
+	}
+	if conv.SourceProbe == nil {
+		conv.SourceProbe, _ = enc.ProbeJSON(ctx, input)
+	}
+	conv.OutputProbe, _ = enc.ProbeJSON(ctx, outPath)
+	// The original is still in place here, so this is the moment to compare.
+	if cfg.Library.Compare {
+		if _, _, err := writeComparison(ctx, cfg, enc, input, outPath); err != nil {
+			log.Printf("warning: comparison for %s: %v", input, err)
+		}
+	}
+	return nil
+}
+
+// hevcMeta tags HEVC pre-pass output as "av1 pending" and links it to where
+// the original will be retained.
+func hevcMeta(c scanner.Candidate, retained string) map[string]string {
+	link := retained
+	if filepath.Dir(retained) == filepath.Dir(c.Path) {
+		link = filepath.Base(retained)
+	}
+	return map[string]string{
+		"comment":              paths.HEVCMetaComment,
+		paths.OriginalTag:      link,
+		paths.OriginalCodecTag: strings.ToLower(c.Codec),
+	}
+}
+
+// retainedPath is where the original of an HEVC pre-pass is kept: next to it,
+// or mirrored under the configured archive folder.
+func retainedPath(cfg Config, p string) string {
+	if cfg.Library.HEVCArchive == "" {
+		return paths.RetainedPath(p)
+	}
+	rel := strings.TrimLeft(strings.TrimPrefix(p, cfg.RootPath), `/\`)
+	return paths.InRoot(cfg.Library.HEVCArchive, rel)
+}
+
+func encodeHEVC(ctx context.Context, enc *ffmpeglib.Encoder, inPath, outPath string, hw ffmpeglib.HWCaps, meta map[string]string, timeout time.Duration, progress func(ffmpeglib.ProgressLine), conv *conversion) error {
 	log.Printf("HEVC hw encode %s -> %s", inPath, outPath)
+	start := time.Now()
+	defer func() { conv.Wall += time.Since(start) }()
 
 	hwCtx, hwCancel := context.WithTimeout(ctx, timeout)
-	err := enc.EncodeToHEVCHW(hwCtx, inPath, outPath, *hw.HEVCProfile, paths.HEVCMetaComment, false, progress)
+	err := enc.EncodeToHEVCHW(hwCtx, inPath, outPath, *hw.HEVCProfile, meta, false, progress)
 	hwCancel()
 
 	if err != nil && ctx.Err() == nil {
 		log.Printf("HEVC encode failed (retrying without subtitles): %v", err)
 		_ = os.Remove(outPath)
+		conv.Dropped.Subtitles = true
 		hwCtx2, hwCancel2 := context.WithTimeout(ctx, timeout)
-		err = enc.EncodeToHEVCHW(hwCtx2, inPath, outPath, *hw.HEVCProfile, paths.HEVCMetaComment, true, progress)
+		err = enc.EncodeToHEVCHW(hwCtx2, inPath, outPath, *hw.HEVCProfile, meta, true, progress)
 		hwCancel2()
 		if err != nil {
 			log.Printf("HEVC retry without subtitles failed: %v", err)
@@ -490,9 +905,49 @@ func isHighBitDepth(pixFmt string) bool {
 	return strings.Contains(pixFmt, "10") || strings.Contains(pixFmt, "12")
 }
 
-func encodeAV1(ctx context.Context, enc *ffmpeglib.Encoder, inPath, outPath string, timeout time.Duration, progress func(ffmpeglib.ProgressLine)) error {
+// encodeAV1 encodes inPath in resumable segments tracked by manifestPath,
+// using the library's rate-control mode. It records in conv the mode actually
+// used (bitrate-based modes fall back to CRF when the source bitrate is
+// unknown) and what the output leaves out. gate, when set, may veto a fresh
+// encode (not a resumed one) after seeing the final settings.
+func encodeAV1(ctx context.Context, enc *ffmpeglib.Encoder, inPath, outPath, manifestPath string, lib config.Library, timeout time.Duration, gate func(string, ffmpeglib.AV1Options) error, progress func(ffmpeglib.ProgressLine), conv *conversion) error {
+	opts, mode := av1Options(ctx, enc, inPath, manifestPath, lib)
+	conv.Mode = mode
+	// Segmented encodes carry only the primary video track.
+	conv.Dropped.ExtraVideo = true
+	if gate != nil && !fileExists(manifestPath) {
+		if err := gate(inPath, opts); err != nil {
+			return err
+		}
+	}
+
 	log.Printf("AV1 sw encode %s -> %s", inPath, outPath)
+	start := time.Now()
+	defer func() { conv.Wall += time.Since(start) }()
+
+	encCtx, encCancel := context.WithTimeout(ctx, timeout)
+	err := enc.EncodeToAV1SVT(encCtx, inPath, outPath, opts, progress)
+	encCancel()
+
+	if err != nil && !errors.Is(err, ffmpeglib.ErrAlreadyAV1) && ctx.Err() == nil {
+		// Finished segments are kept, so only the final mux is redone.
+		log.Printf("AV1 encode failed (retrying without subtitles): %v", err)
+		_ = os.Remove(outPath)
+		opts.DropSubtitles = true
+		conv.Dropped.Subtitles = true
+		encCtx2, encCancel2 := context.WithTimeout(ctx, timeout)
+		err = enc.EncodeToAV1SVT(encCtx2, inPath, outPath, opts, progress)
+		encCancel2()
+		if err != nil {
+			log.Printf("AV1 retry without subtitles failed: %v", err)
+		}
+	}
+	return err
+}
 
+// av1Options builds the encoder settings for inPath under the library's
+// rate-control mode, returning the mode actually used.
+func av1Options(ctx context.Context, enc *ffmpeglib.Encoder, inPath, manifestPath string, lib config.Library) (ffmpeglib.AV1Options, string) {
 	pixFmt := "yuv420p10le"
 	if pf, err := enc.VideoPixFmt(ctx, inPath); err == nil && pf != "" && !isHighBitDepth(pf) {
 		pixFmt = "yuv420p"
@@ -506,39 +961,90 @@ func encodeAV1(ctx context.Context, enc *ffmpeglib.Encoder, inPath, outPath stri
 		Container:        "mkv",
 		PixFmt:           pixFmt,
 		MetaComment:      paths.MetaComment,
+		ManifestPath:     manifestPath,
 	}
 
-	encCtx, encCancel := context.WithTimeout(ctx, timeout)
-	err := enc.EncodeToAV1SVT(encCtx, inPath, outPath, opts, progress)
-	encCancel()
-
-	if err != nil && !errors.Is(err, ffmpeglib.ErrAlreadyAV1) && ctx.Err() == nil {
-		log.Printf("AV1 encode failed (retrying without subtitles): %v", err)
-		_ = os.Remove(outPath)
-		opts.DropSubtitles = true
-		encCtx2, encCancel2 := context.WithTimeout(ctx, timeout)
-		err = enc.EncodeToAV1SVT(encCtx2, inPath, outPath, opts, progress)
-		encCancel2()
+	mode := lib.AV1Mode
+	if mode != config.ModeCRF {
+		srcRate, err := enc.SourceVideoBitrate(ctx, inPath)
 		if err != nil {
-			log.Printf("AV1 retry without subtitles failed: %v", err)
+			log.Printf("cannot determine source bitrate (%v), using %s instead of %s", err, config.ModeCRF, mode)
+			mode = config.ModeCRF
+		} else {
+			rate := int64(float64(srcRate) * lib.BitrateFraction)
+			if mode == config.ModeVBR {
+				opts.TargetBitrate = rate
+				log.Printf("AV1 vbr: source video %d kb/s, target %d kb/s", srcRate/1000, rate/1000)
+			} else {
+				opts.MaxBitrate = rate
+				log.Printf("AV1 hybrid: crf %d, source video %d kb/s, cap %d kb/s", opts.CRF, srcRate/1000, rate/1000)
+			}
 		}
 	}
-	return err
+	opts.Metadata = map[string]string{paths.ModeTag: mode}
+	return opts, mode
+}
+
+// finishConversion replaces the original with its validated output, or in
+// review mode parks the output until someone approves the swap.
+func finishConversion(cfg Config, c scanner.Candidate, outPath string, conv conversion, st *status) {
+	if !cfg.Library.Review {
+		replaceOriginal(cfg, c, outPath, conv, st)
+		return
+	}
+	if err := parkForReview(cfg, c, outPath, conv); err != nil {
+		// Left in place, the output would be picked up and swapped in by
+		// restart recovery without a review.
+		log.Printf("error: cannot park %s for review: %v; discarding output", outPath, err)
+		_ = cfg.FS.Remove(outPath)
+		return
+	}
+	st.finishEncode(0)
 }
 
-func finishConversion(fsys vfs.FS, c scanner.Candidate, outPath, rootPath string, noDelete bool, encType string, st *status) {
+func replaceOriginal(cfg Config, c scanner.Candidate, outPath string, conv conversion, st *status) {
+	fsys, noDelete := cfg.FS, cfg.NoDelete
 	outInfo, err := fsys.Stat(outPath)
 	if err != nil {
 		log.Printf("error: cannot stat output %s: %v", outPath, err)
 		return
 	}
 	outSize := outInfo.Size()
-	saved := c.Size - outSize
-	st.finishEncode(saved)
-	log.Printf("validated OK [%s]: %s saved (%s -> %s)",
-		encType, scanner.HumanSize(saved), scanner.HumanSize(c.Size), scanner.HumanSize(outSize))
 
-	retireOriginal(fsys, c.Path, noDelete)
+	fromCodec, origPath, origSize := c.Codec, c.Path, c.Size
+	switch {
+	case conv.EncType == "hevc":
+		// Pre-pass: keep the original so the AV1 stage can encode from it
+		// instead of from this second-generation copy.
+		if err := moveFile(fsys, c.Path, conv.Retained); err != nil {
+			log.Printf("error: cannot retain original %s -> %s: %v; discarding HEVC output", c.Path, conv.Retained, err)
+			_ = fsys.Remove(outPath)
+			return
+		}
+		st.finishEncode(0)
+		log.Printf("validated OK [hevc]: %s -> %s, original kept at %s until AV1",
+			scanner.HumanSize(c.Size), scanner.HumanSize(outSize), conv.Retained)
+	case c.Source != "":
+		// AV1 stage from a retained original: both earlier generations go.
+		fromCodec, origPath, origSize = c.SourceCodec, c.Source, c.SourceSize
+		saved := c.Size + c.SourceSize - outSize
+		st.finishEncode(saved)
+		log.Printf("validated OK [%s]: %s saved (%s + retained original %s -> %s)",
+			conv.EncType, scanner.HumanSize(saved), scanner.HumanSize(c.Size),
+			scanner.HumanSize(c.SourceSize), scanner.HumanSize(outSize))
+		retireOriginal(fsys, c.Path, noDelete)
+		retireOriginal(fsys, c.Source, noDelete)
+	default:
+		saved := c.Size - outSize
+		st.finishEncode(saved)
+		log.Printf("validated OK [%s]: %s saved (%s -> %s)",
+			conv.EncType, scanner.HumanSize(saved), scanner.HumanSize(c.Size), scanner.HumanSize(outSize))
+		retireOriginal(fsys, c.Path, noDelete)
+	}
+	if conv.Pred != nil {
+		actual := 1 - float64(outSize)/float64(origSize)
+		log.Printf("preflight predicted %.0f%% savings, actual %.0f%%", conv.Pred.Ratio*100, actual*100)
+	}
 
 	finalPath := outPath
 	base := filepath.Base(outPath)
@@ -551,24 +1057,92 @@ func finishConversion(fsys vfs.FS, c scanner.Candidate, outPath, rootPath string
 		}
 	}
 
-	appendTally(fsys, rootPath, encType, c.Codec, c.Path, c.Size, finalPath, outSize)
+	if conv.OutputSHA256 == "" {
+		if conv.OutputSHA256, err = fsys.Hash(finalPath); err != nil {
+			log.Printf("warning: cannot checksum %s: %v", finalPath, err)
+		}
+	}
+	appendTally(fsys, cfg.RootPath, conv.EncType, conv, fromCodec, origPath, origSize, finalPath, outSize)
+	appendAudit(cfg, conv, fromCodec, origPath, origSize, finalPath, outSize)
 	log.Printf("done: %s", finalPath)
 }
 
-func appendTally(fsys vfs.FS, rootPath, encType, fromCodec, origPath string, origSize int64, outPath string, outSize int64) {
+// recordFailure adds a tally row for an encode that produced nothing usable,
+// so the savings model counts the time it wasted. outSize is what the output
+// reached, if known.
+func recordFailure(cfg Config, c scanner.Candidate, conv conversion, outSize int64) {
+	appendTally(cfg.FS, cfg.RootPath, scanner.TallyFailed, conv, c.Codec, c.Path, c.Size, "", outSize)
+}
+
+func sizeOf(fsys vfs.FS, path string) int64 {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// appendTally adds a row to the tally. kind is the encoder type for
+// completed conversions, or scanner.TallyFailed.
+func appendTally(fsys vfs.FS, rootPath, kind string, conv conversion, fromCodec, origPath string, origSize int64, outPath string, outSize int64) {
 	f, err := fsys.OpenFile(filepath.Join(rootPath, paths.TallyFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
 	if err != nil {
 		return
 	}
 	defer f.Close()
-	fmt.Fprintf(f, "%s\t%s\t%s\t%d\t%d\t%s\t%s\n",
-		time.Now().Format(time.RFC3339), encType, fromCodec, origSize, outSize, origPath, outPath)
+	pred := ""
+	if conv.Pred != nil {
+		pred = strconv.FormatFloat(conv.Pred.Ratio, 'f', 4, 64)
+	}
+	fmt.Fprintf(f, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%.3f\n",
+		time.Now().Format(time.RFC3339), kind, fromCodec, origSize, outSize, origPath, outPath, conv.Mode, pred,
+		qualityColumn(conv.Validation.Quality), conv.OutputSHA256, conv.Wall.Hours())
+}
+
+// qualityColumn formats scores as "metric:mean/min/p5", comma separated.
+func qualityColumn(scores []ffmpeglib.QualityScores) string {
+	parts := make([]string, len(scores))
+	for i, q := range scores {
+		parts[i] = fmt.Sprintf("%s:%.3f/%.3f/%.3f", q.Metric, q.Mean, q.Min, q.P5)
+	}
+	return strings.Join(parts, ",")
+}
+
+// moveFile renames src to dst, creating dst's folder, and falls back to
+// copy + remove when a rename is not possible (e.g. across devices).
+func moveFile(fsys vfs.FS, src, dst string) error {
+	if i := strings.LastIndexAny(dst, `/\`); i > 0 {
+		if err := fsys.MkdirAll(dst[:i], 0o755); err != nil {
+			return err
+		}
+	}
+	if err := fsys.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fsys.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		_ = fsys.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		_ = fsys.Remove(dst)
+		return err
+	}
+	return fsys.Remove(src)
 }
 
 func retireOriginal(fsys vfs.FS, path string, noDelete bool) {
 	if noDelete {
-		ext := filepath.Ext(path)
-		tagged := path[:len(path)-len(ext)] + paths.DeleteMeTag + ext
+		tagged := paths.DeleteMePath(path)
 		if err := fsys.Rename(path, tagged); err != nil {
 			log.Printf("warning: could not rename original %s -> %s: %v", path, tagged, err)
 		}
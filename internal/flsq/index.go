@@ -0,0 +1,161 @@
+package flsq
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/scanner"
+)
+
+// The index subcommands work on this host's index of the library. Those
+// that rewrite it take the index lock, which scans hold while they rewrite
+// the index as they go, and refuse to run while a scan on this host does.
+
+// indexLockStale is when an index lock left by a process that can no longer
+// be checked is broken; locks of processes gone from this host are broken
+// right away.
+const indexLockStale = 24 * time.Hour
+
+// lockIndex takes this host's index lock.
+func lockIndex(cfg Config) (release func(), err error) {
+	release, err = acquireLock(cfg.FS, scanner.IndexPath(cfg.RootPath), indexLockStale)
+	if err != nil {
+		return nil, fmt.Errorf("index in use by a scan: %w", err)
+	}
+	return release, nil
+}
+
+// VerifyIndex prints what is wrong with the index, if anything, and fails
+// when it finds problems.
+func VerifyIndex(cfg Config, w io.Writer) error {
+	rep, err := scanner.VerifyIndex(cfg.FS, cfg.RootPath)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: version %d, %d entries\n", rep.Path, rep.Version, rep.Entries)
+	if rep.Outdated() {
+		fmt.Fprintln(w, "older format; the next scan upgrades it")
+	}
+	if rep.Other != "" {
+		fmt.Fprintf(w, "%s also exists: a scan was interrupted or is running; the next scan keeps the larger file\n", rep.Other)
+	}
+	for _, p := range rep.Problems {
+		fmt.Fprintf(w, "line %d: %s\n", p.Line, p.Msg)
+	}
+	if len(rep.Problems) > 0 {
+		return fmt.Errorf("index: %d problems (index compact rewrites it without them)", len(rep.Problems))
+	}
+	fmt.Fprintln(w, "ok")
+	return nil
+}
+
+// CompactIndex drops the index entries of files that no longer exist.
+func CompactIndex(cfg Config, w io.Writer) error {
+	release, err := lockIndex(cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	dropped, err := scanner.CompactIndex(cfg.FS, cfg.RootPath)
+	if err != nil {
+		return err
+	}
+	if cfg.Verbose {
+		for _, p := range dropped {
+			fmt.Fprintf(w, "dropped %s\n", p)
+		}
+	}
+	fmt.Fprintf(w, "%d entries of missing files dropped\n", len(dropped))
+	return nil
+}
+
+// exportEntry is an index entry as ExportIndex writes it in JSON.
+type exportEntry struct {
+	Path    string    `json:"path"`
+	Codec   string    `json:"codec"`
+	ModTime time.Time `json:"mtime"`
+	Size    int64     `json:"size"`
+	scanner.FileMeta
+}
+
+// exportColumns head the CSV export.
+var exportColumns = []string{
+	"path", "codec", "mtime", "size", "fingerprint", "width", "height", "fps",
+	"duration", "video_bitrate", "format", "predicted_savings", "predicted_hours",
+}
+
+// ExportIndex writes the index to w as CSV, one row per file, or with
+// cfg.JSON as JSON lines carrying everything cached.
+func ExportIndex(cfg Config, w io.Writer) error {
+	entries := scanner.LoadIndex(cfg.FS, cfg.RootPath)
+	if entries == nil {
+		return fmt.Errorf("no index for %s in %s (run a scan first)", paths.Hostname(), cfg.RootPath)
+	}
+	if cfg.JSON {
+		enc := json.NewEncoder(w)
+		for _, e := range entries {
+			if err := enc.Encode(exportEntry{e.Path, e.Codec, e.ModTime, e.Size, e.Meta}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(exportColumns)
+	num := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	for _, e := range entries {
+		row := make([]string, len(exportColumns))
+		row[0], row[1] = e.Path, e.Codec
+		row[2] = e.ModTime.UTC().Format(time.RFC3339)
+		row[3] = strconv.FormatInt(e.Size, 10)
+		row[4] = e.Meta.FP
+		if v := e.Meta.Video; v != nil {
+			row[5], row[6] = strconv.Itoa(v.Width), strconv.Itoa(v.Height)
+			row[7], row[8] = num(v.FPS), num(v.Duration)
+			row[9] = strconv.FormatInt(v.Bitrate, 10)
+		}
+		if p := e.Meta.Probe; p != nil {
+			row[10] = p.Format
+		}
+		if p := e.Meta.Pred; p != nil {
+			row[11], row[12] = num(p.Ratio), num(p.Hours)
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// RebuildIndex probes the files and folders in cfg.Paths again and replaces
+// what the index cached for them.
+func RebuildIndex(ctx context.Context, cfg Config, w io.Writer) error {
+	if len(cfg.Paths) == 0 {
+		return fmt.Errorf("index rebuild: name the files or folders to probe again (. for the whole library)")
+	}
+	enc, err := setup(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	release, err := lockIndex(cfg)
+	if err != nil {
+		return err
+	}
+	defer release()
+	batch := 1
+	if cfg.FS.IsRemote() {
+		batch = remoteProbeBatch
+	}
+	probed, dropped, err := scanner.RebuildIndex(ctx, cfg.FS, enc, cfg.RootPath, cfg.Paths, batch)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%d files probed again, %d entries of missing files dropped\n", probed, dropped)
+	return nil
+}
@@ -2,8 +2,11 @@ package flsq
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/snadrus/flicksqueeze/internal/paths"
@@ -26,7 +29,7 @@ func acquireLock(fsys vfs.FS, inputPath string, timeout time.Duration) (release
 	if statErr != nil {
 		return nil, fmt.Errorf("cannot stat lock %s: %w", lockPath, statErr)
 	}
-	if time.Since(info.ModTime()) < timeout {
+	if time.Since(info.ModTime()) < timeout && !orphanedLock(fsys, lockPath) {
 		return nil, fmt.Errorf("locked by another instance (mtime %s)", info.ModTime().Format(time.RFC3339))
 	}
 
@@ -45,11 +48,51 @@ func tryCreateLock(fsys vfs.FS, lockPath string) error {
 	if err != nil {
 		return err
 	}
-	fmt.Fprintf(f, "%s %s\n", paths.Hostname(), time.Now().Format(time.RFC3339))
+	fmt.Fprintf(f, "%s %s %d\n", paths.Hostname(), time.Now().Format(time.RFC3339), os.Getpid())
 	return f.Close()
 }
 
+// orphanedLock reports whether the lock was left behind by a process on this
+// host that no longer runs (crash, reboot), so its encode can be resumed
+// without waiting for the lock to go stale.
+func orphanedLock(fsys vfs.FS, lockPath string) bool {
+	host, pid, err := lockOwner(fsys, lockPath)
+	if err != nil || host != paths.Hostname() || pid == os.Getpid() {
+		return false
+	}
+	return !processAlive(pid)
+}
+
+// lockOwner reads the host and pid tryCreateLock wrote to the lock.
+func lockOwner(fsys vfs.FS, lockPath string) (host string, pid int, err error) {
+	rc, err := fsys.Open(lockPath)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 1024))
+	if err != nil {
+		return "", 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return "", 0, fmt.Errorf("unreadable lock %q", data)
+	}
+	pid, err = strconv.Atoi(fields[2])
+	return fields[0], pid, err
+}
+
+// removeLock removes our lock, unless another process broke it as stale and
+// holds it now.
 func removeLock(fsys vfs.FS, lockPath string) {
+	host, pid, err := lockOwner(fsys, lockPath)
+	switch {
+	case os.IsNotExist(err):
+		return
+	case err == nil && (host != paths.Hostname() || pid != os.Getpid()):
+		log.Printf("warning: lock %s was taken over by %s (pid %d), leaving it", lockPath, host, pid)
+		return
+	}
 	if err := fsys.Remove(lockPath); err != nil && !os.IsNotExist(err) {
 		log.Printf("warning: could not remove lock %s: %v", lockPath, err)
 	}
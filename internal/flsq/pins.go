@@ -0,0 +1,43 @@
+package flsq
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/snadrus/flicksqueeze/internal/scanner"
+)
+
+// consolePins handles the pin keys of the interactive console: "p" lists the
+// pins, "p <path>" pins a file or folder (relative to the library root, or
+// absolute) and "u <path>" unpins it. The scan picks pins up before sending
+// its next candidate.
+func consolePins(cfg Config, w io.Writer, line string) bool {
+	key, arg, _ := strings.Cut(line, " ")
+	arg = strings.Trim(strings.TrimSpace(arg), `"'`)
+	switch {
+	case key == "p" && arg == "":
+		pins := scanner.LoadPins(cfg.FS, cfg.RootPath)
+		if len(pins) == 0 {
+			fmt.Fprintln(w, "nothing pinned")
+		}
+		for i, p := range pins {
+			fmt.Fprintf(w, "%3d. %s\n", i+1, p)
+		}
+	case key == "p":
+		if err := scanner.Pin(cfg.FS, cfg.RootPath, arg); err != nil {
+			fmt.Fprintf(w, "pin: %v\n", err)
+		} else {
+			fmt.Fprintf(w, "pinned %s; it goes first from the next candidate on\n", arg)
+		}
+	case key == "u" && arg != "":
+		if err := scanner.Unpin(cfg.FS, cfg.RootPath, arg); err != nil {
+			fmt.Fprintf(w, "unpin: %v\n", err)
+		} else {
+			fmt.Fprintf(w, "unpinned %s\n", arg)
+		}
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package flsq
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/snadrus/flicksqueeze/internal/scanner"
+)
+
+// Plan scans the library without encoding anything and prints the candidates
+// in the order they would be converted, each with how it was scored and
+// ranked.
+func Plan(ctx context.Context, cfg Config, w io.Writer) error {
+	enc, err := setup(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+
+	release, err := lockIndex(cfg)
+	if err != nil {
+		return err
+	}
+	opts := scanOptions(cfg, enc.DetectHW(ctx))
+	opts.Indexed = release
+	ch := make(chan scanner.Candidate)
+	go scanner.Scan(ctx, cfg.FS, enc, cfg.RootPath, ch, opts)
+	var all []scanner.Candidate
+	for c := range ch {
+		all = append(all, c)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	scanner.SortCandidates(all)
+	var total float64
+	for i, c := range all {
+		fmt.Fprintf(w, "%4d. [%s] %s (%s)\n", i+1, scanner.HumanSize(c.Size), c.Path, fmtWaste(c.WasteScore))
+		fmt.Fprintf(w, "      %s\n", c.Why)
+		if c.RankWhy != "" {
+			fmt.Fprintf(w, "      ranked by %s\n", c.RankWhy)
+		}
+		total += c.WasteScore
+	}
+	fmt.Fprintf(w, "\n%d candidates, ~%s reclaimable\n", len(all), scanner.HumanSize(int64(total)))
+	return nil
+}
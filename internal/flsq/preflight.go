@@ -0,0 +1,106 @@
+package flsq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
+	"github.com/snadrus/flicksqueeze/internal/scanner"
+)
+
+// Preflight: before committing hours to a full AV1 encode, a few short
+// samples spread across the file are encoded with the real settings and
+// extrapolated to the whole file. Files predicted to save too little are
+// skipped, and the prediction is cached in the index so later scans rank and
+// skip them without sampling again.
+
+const (
+	preflightSamples   = 3
+	preflightSampleSec = 20.0
+	preflightMinSec    = 600.0 // shorter files are cheap enough to just encode
+)
+
+// errNotWorthIt means preflight predicted savings below the library threshold.
+var errNotWorthIt = errors.New("preflight predicts too little savings")
+
+// preflightGate returns the check encodeAV1 runs before encoding c, or nil
+// when preflight does not apply. A prediction made here is recorded in conv
+// for the tally.
+func preflightGate(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, c scanner.Candidate, conv *conversion) func(inPath string, opts ffmpeglib.AV1Options) error {
+	// The AV1 stage after an HEVC pre-pass also frees the HEVC copy, so it
+	// is always worth doing.
+	if !cfg.Library.Preflight || c.Stage != "" {
+		return nil
+	}
+	return func(inPath string, opts ffmpeglib.AV1Options) error {
+		pred := c.Meta.Pred
+		if pred == nil {
+			p, ok, err := predict(ctx, enc, inPath, c.Size, opts)
+			if err != nil {
+				if ctx.Err() != nil {
+					return err
+				}
+				log.Printf("preflight failed for %s (encoding anyway): %v", c.Path, err)
+				return nil
+			}
+			if !ok {
+				return nil
+			}
+			if info, err := cfg.FS.Stat(c.Path); err == nil {
+				scanner.SavePrediction(cfg.FS, cfg.RootPath, c.Path, info.Size(), info.ModTime(), p)
+			}
+			pred = &p
+		}
+		conv.Pred = pred
+		log.Printf("preflight: %s predicted to save %.0f%% in ~%.1fh",
+			c.Path, pred.Ratio*100, pred.Hours)
+		if pred.Ratio < cfg.Library.PreflightMinSavings {
+			return fmt.Errorf("%w: %.0f%% < %.0f%%", errNotWorthIt,
+				pred.Ratio*100, cfg.Library.PreflightMinSavings*100)
+		}
+		return nil
+	}
+}
+
+// predict sample-encodes inPath and extrapolates savings and encode time.
+// ok is false for files too short to be worth sampling.
+func predict(ctx context.Context, enc *ffmpeglib.Encoder, inPath string, inSize int64, opts ffmpeglib.AV1Options) (pred scanner.Prediction, ok bool, err error) {
+	dur, err := enc.DurationSeconds(ctx, inPath)
+	if err != nil {
+		return pred, false, err
+	}
+	if dur < preflightMinSec {
+		return pred, false, nil
+	}
+
+	// Evenly spaced, centred samples stay clear of opening titles and end
+	// credits, which compress unusually well.
+	starts := make([]float64, preflightSamples)
+	for i := range starts {
+		starts[i] = dur*float64(i+1)/float64(preflightSamples+1) - preflightSampleSec/2
+	}
+	res, err := enc.SampleEncode(ctx, inPath, opts, starts, preflightSampleSec)
+	if err != nil {
+		return pred, false, err
+	}
+	if res.Seconds <= 0 || res.Bytes <= 0 {
+		return pred, false, errors.New("samples produced no output")
+	}
+	scale := dur / res.Seconds
+
+	// Audio, subtitles and container overhead are copied unchanged. Without
+	// a known video bitrate they cannot be told apart, so the whole input
+	// counts as video.
+	other := 0.0
+	if br, err := enc.SourceVideoBitrate(ctx, inPath); err == nil {
+		other = math.Max(float64(inSize)-float64(br)/8*dur, 0)
+	}
+	projected := float64(res.Bytes)*scale + other
+
+	pred.Ratio = 1 - projected/float64(inSize)
+	pred.Hours = res.Wall.Hours() * scale
+	return pred, true, nil
+}
@@ -0,0 +1,14 @@
+package flsq
+
+import "os"
+
+// processAlive reports whether a process with the given pid exists.
+// On Windows FindProcess opens a handle and fails if the pid is gone.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -0,0 +1,295 @@
+package flsq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/scanner"
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+// Review mode: validated outputs are parked in the state folder with what is
+// needed to finish the conversion later, and the original stays in place
+// until someone approves (replace) or rejects (discard) the swap. Parked
+// conversions are plain files, so they survive restarts.
+
+// reviewItem is a conversion awaiting a decision, saved as <id>.json next to
+// the parked output <id>.mkv.
+type reviewItem struct {
+	Path     string            `json:"path"` // relative to the library root; read by the scanner
+	Root     string            `json:"root"` // library root as spelled when parked
+	Queued   time.Time         `json:"queued"`
+	OutPath  string            `json:"out_path"` // where the output goes on approval
+	OutSize  int64             `json:"out_size"`
+	C        scanner.Candidate `json:"candidate"`
+	Conv     conversion        `json:"conversion"`
+	Encoders map[string]string `json:"encoders,omitempty"`
+}
+
+// reviewID names the review files of the library file at rel.
+func reviewID(rel string) string {
+	h := fnv.New64a()
+	h.Write([]byte(rel))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+func reviewFile(rootPath, id, ext string) string {
+	return paths.InState(rootPath, paths.ReviewDir+"/"+id+ext)
+}
+
+// parkForReview moves a validated output into the review folder and records
+// how to finish its conversion.
+func parkForReview(cfg Config, c scanner.Candidate, outPath string, conv conversion) error {
+	info, err := cfg.FS.Stat(outPath)
+	if err != nil {
+		return err
+	}
+	item := reviewItem{
+		Path:     paths.Rel(cfg.RootPath, c.Path),
+		Root:     cfg.RootPath,
+		Queued:   time.Now(),
+		OutPath:  outPath,
+		OutSize:  info.Size(),
+		C:        c,
+		Conv:     conv,
+		Encoders: cfg.Encoders,
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	id := reviewID(item.Path)
+	if err := cfg.FS.MkdirAll(paths.InState(cfg.RootPath, paths.ReviewDir), 0o755); err != nil {
+		return err
+	}
+	// The description is written first: a parked output without one could
+	// never be approved.
+	jsonPath := reviewFile(cfg.RootPath, id, ".json")
+	if err := writeFile(cfg.FS, jsonPath, data); err != nil {
+		return err
+	}
+	if err := moveFile(cfg.FS, outPath, reviewFile(cfg.RootPath, id, paths.OutputExt)); err != nil {
+		_ = cfg.FS.Remove(jsonPath)
+		return err
+	}
+	log.Printf("awaiting review: %s (%s -> %s); approve or reject with: flicksqueeze approve|reject %q",
+		c.Path, scanner.HumanSize(c.Size), scanner.HumanSize(item.OutSize), c.Path)
+	return nil
+}
+
+func writeFile(fsys vfs.FS, path string, data []byte) error {
+	f, err := fsys.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// listReviews returns the library's pending reviews, oldest first.
+func listReviews(fsys vfs.FS, rootPath string) ([]reviewItem, error) {
+	dir := paths.InState(rootPath, paths.ReviewDir)
+	if _, err := fsys.Stat(dir); err != nil {
+		return nil, nil
+	}
+	var items []reviewItem
+	err := fsys.Walk(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		item, err := readReview(fsys, p)
+		if err != nil {
+			log.Printf("warning: %s: %v", p, err)
+			return nil
+		}
+		item.rebase(rootPath)
+		items = append(items, item)
+		return nil
+	})
+	sort.Slice(items, func(i, j int) bool { return items[i].Queued.Before(items[j].Queued) })
+	return items, err
+}
+
+func readReview(fsys vfs.FS, p string) (item reviewItem, err error) {
+	rc, err := fsys.Open(p)
+	if err != nil {
+		return item, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return item, err
+	}
+	return item, json.Unmarshal(data, &item)
+}
+
+// findReview locates the pending review of file by walking up to the
+// library root holding it.
+func findReview(fsys vfs.FS, file string) (rootPath string, item reviewItem, err error) {
+	for dir := parentDir(file); ; {
+		p := reviewFile(dir, reviewID(paths.Rel(dir, file)), ".json")
+		if _, statErr := fsys.Stat(p); statErr == nil {
+			item, err = readReview(fsys, p)
+			return dir, item, err
+		}
+		up := parentDir(dir)
+		if up == dir {
+			return "", item, fmt.Errorf("%s is not awaiting review", file)
+		}
+		dir = up
+	}
+}
+
+// rebase moves the item's paths onto rootPath, in case the library root is
+// spelled differently than when the output was parked.
+func (item *reviewItem) rebase(rootPath string) {
+	if item.Root == rootPath {
+		return
+	}
+	move := func(p *string) {
+		if *p != "" && strings.HasPrefix(*p, item.Root) {
+			*p = paths.InRoot(rootPath, paths.Rel(item.Root, *p))
+		}
+	}
+	move(&item.C.Path)
+	move(&item.C.Source)
+	move(&item.OutPath)
+	move(&item.Conv.Retained)
+	item.Root = rootPath
+}
+
+// approveReview puts the parked output back and finishes the conversion.
+func approveReview(cfg Config, rootPath string, item reviewItem) error {
+	item.rebase(rootPath)
+	id := reviewID(item.Path)
+	info, err := cfg.FS.Stat(item.C.Path)
+	if err != nil {
+		return fmt.Errorf("original %s is gone: %w", item.C.Path, err)
+	}
+	if info.Size() != item.C.Size {
+		return fmt.Errorf("original %s changed since it was converted; reject this review", item.C.Path)
+	}
+	if _, err := cfg.FS.Stat(item.OutPath); err == nil {
+		return fmt.Errorf("%s already exists", item.OutPath)
+	}
+	if err := moveFile(cfg.FS, reviewFile(rootPath, id, paths.OutputExt), item.OutPath); err != nil {
+		return fmt.Errorf("cannot restore output: %w", err)
+	}
+	_ = cfg.FS.Remove(reviewFile(rootPath, id, ".json"))
+
+	cfg.RootPath = rootPath
+	cfg.Encoders = item.Encoders
+	log.Printf("approved: %s", item.C.Path)
+	replaceOriginal(cfg, item.C, item.OutPath, item.Conv, &status{})
+	return nil
+}
+
+// rejectReview discards the parked output and keeps the original, listing it
+// as failed so it is not converted again.
+func rejectReview(cfg Config, rootPath string, item reviewItem) error {
+	item.rebase(rootPath)
+	id := reviewID(item.Path)
+	if err := cfg.FS.Remove(reviewFile(rootPath, id, paths.OutputExt)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := cfg.FS.Remove(reviewFile(rootPath, id, ".json")); err != nil {
+		return err
+	}
+	scanner.MarkFailed(cfg.FS, rootPath, item.C.Path, "review: rejected")
+	log.Printf("rejected: %s (original kept)", item.C.Path)
+	return nil
+}
+
+// Approve replaces the original of a conversion awaiting review with its
+// output. file names the original.
+func Approve(cfg Config, file string) error {
+	root, item, err := findReview(cfg.FS, file)
+	if err != nil {
+		return err
+	}
+	return approveReview(cfg, root, item)
+}
+
+// Reject discards the output of a conversion awaiting review.
+func Reject(cfg Config, file string) error {
+	root, item, err := findReview(cfg.FS, file)
+	if err != nil {
+		return err
+	}
+	return rejectReview(cfg, root, item)
+}
+
+// Reviews lists the conversions awaiting review in the library at
+// cfg.RootPath.
+func Reviews(cfg Config, w io.Writer) error {
+	items, err := listReviews(cfg.FS, cfg.RootPath)
+	if err != nil {
+		return err
+	}
+	printReviews(w, items)
+	return nil
+}
+
+func printReviews(w io.Writer, items []reviewItem) {
+	if len(items) == 0 {
+		fmt.Fprintln(w, "no conversions awaiting review")
+		return
+	}
+	for i, item := range items {
+		fmt.Fprintf(w, "%3d. %s\n", i+1, item.C.Path)
+		fmt.Fprintf(w, "     %s %s -> %s %s (%.0f%% smaller), parked %s\n",
+			item.C.Codec, scanner.HumanSize(item.C.Size), item.Conv.EncType, scanner.HumanSize(item.OutSize),
+			(1-float64(item.OutSize)/float64(item.C.Size))*100, item.Queued.Local().Format(time.DateTime))
+		if len(item.Conv.Validation.Checks) > 0 {
+			fmt.Fprintf(w, "     %s\n", item.Conv.Validation)
+		}
+	}
+}
+
+// consoleReview handles the review keys of the interactive console:
+// "r" lists pending reviews, "a N" approves and "x N" rejects the Nth.
+func consoleReview(cfg Config, w io.Writer, line string) bool {
+	f := strings.Fields(line)
+	if len(f) == 0 || len(f) > 2 || (f[0] != "r" && f[0] != "a" && f[0] != "x") {
+		return false
+	}
+	items, err := listReviews(cfg.FS, cfg.RootPath)
+	if err != nil {
+		fmt.Fprintf(w, "reviews: %v\n", err)
+		return true
+	}
+	if f[0] == "r" {
+		printReviews(w, items)
+		return true
+	}
+	var n int
+	if len(f) != 2 {
+		fmt.Fprintf(w, "usage: %s <number from r>\n", f[0])
+		return true
+	}
+	if _, err := fmt.Sscan(f[1], &n); err != nil || n < 1 || n > len(items) {
+		fmt.Fprintf(w, "no review %q (see r)\n", f[1])
+		return true
+	}
+	if f[0] == "a" {
+		err = approveReview(cfg, cfg.RootPath, items[n-1])
+	} else {
+		err = rejectReview(cfg, cfg.RootPath, items[n-1])
+	}
+	if err != nil {
+		fmt.Fprintf(w, "%v\n", err)
+	}
+	return true
+}
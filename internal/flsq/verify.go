@@ -0,0 +1,143 @@
+package flsq
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/scanner"
+)
+
+// Library audit: outputs the scanner recognises as ours are never looked at
+// again, so the audit command re-verifies everything converted so far, from
+// the tally and the index, and writes what it found to a report.
+
+// verifyTarget is one converted output to check, with what the tally
+// recorded about it (nil for outputs known only from the index).
+type verifyTarget struct {
+	path string
+	row  *scanner.TallyRow
+}
+
+// verifyTargets lists the library's outputs, latest tally row per output.
+func verifyTargets(cfg Config) []verifyTarget {
+	byPath := make(map[string]*scanner.TallyRow)
+	moves := scanner.LoadMoves(cfg.FS, cfg.RootPath)
+	for _, row := range scanner.LoadTallyRows(cfg.FS, paths.InRoot(cfg.RootPath, paths.TallyFile)) {
+		row.OrigPath = scanner.Moved(moves, row.OrigPath)
+		row.OutPath = scanner.Moved(moves, row.OutPath)
+		byPath[row.OutPath] = &row
+	}
+	for _, p := range scanner.IndexedAs(cfg.FS, cfg.RootPath, "flicksqueeze") {
+		if _, ok := byPath[p]; !ok {
+			byPath[p] = nil
+		}
+	}
+	targets := make([]verifyTarget, 0, len(byPath))
+	for p, row := range byPath {
+		targets = append(targets, verifyTarget{path: p, row: row})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].path < targets[j].path })
+	return targets
+}
+
+// verifyOutput returns what is wrong with one output, if anything. skip is
+// set for HEVC pre-pass outputs that the AV1 stage has since replaced.
+func verifyOutput(ctx context.Context, cfg Config, enc *ffmpeglib.Encoder, t verifyTarget) (problems []string, skip bool) {
+	info, err := cfg.FS.Stat(t.path)
+	if err != nil {
+		if t.row != nil && t.row.Type == "hevc" {
+			return nil, true
+		}
+		return []string{"missing"}, false
+	}
+	if comment, err := enc.Comment(ctx, t.path); err != nil {
+		problems = append(problems, "unreadable: "+err.Error())
+	} else if !paths.IsOurComment(comment) {
+		problems = append(problems, "marker gone")
+	}
+	if t.row != nil && info.Size() != t.row.OutSize {
+		problems = append(problems, fmt.Sprintf("size %d, tally says %d", info.Size(), t.row.OutSize))
+	}
+	if t.row != nil && t.row.SHA256 != "" {
+		if sum, err := cfg.FS.Hash(t.path); err != nil {
+			problems = append(problems, "cannot hash: "+err.Error())
+		} else if sum != t.row.SHA256 {
+			problems = append(problems, "sha256 differs from tally")
+		}
+	}
+	rep, err := enc.DecodeCheck(ctx, t.path)
+	switch {
+	case err != nil:
+		problems = append(problems, "decode: "+err.Error())
+	case rep.Errors > cfg.Library.DecodeMaxErrors:
+		problems = append(problems, fmt.Sprintf("decode: %d errors, first: %s", rep.Errors, strings.Join(rep.First, " | ")))
+	case rep.Frames == 0:
+		problems = append(problems, "decode: no video frames")
+	}
+	return problems, false
+}
+
+// Audit re-verifies every converted output in the library: it must exist,
+// carry our marker, match the size and checksum in the tally and fully
+// decode. Results go to .flicksqueeze/audit.tsv; failures whose original was
+// kept by --no-delete are flagged for restore from it.
+func Audit(ctx context.Context, cfg Config, w io.Writer) error {
+	enc, err := setup(ctx, &cfg)
+	if err != nil {
+		return err
+	}
+	if err := cfg.FS.MkdirAll(paths.InRoot(cfg.RootPath, paths.StateDir), 0o755); err != nil {
+		return err
+	}
+	reportPath := paths.InState(cfg.RootPath, paths.LibraryAuditFile)
+	report, err := cfg.FS.Create(reportPath)
+	if err != nil {
+		return err
+	}
+	defer report.Close()
+	fmt.Fprintf(report, "# flicksqueeze audit %s: path, result, problems, restore from\n", time.Now().Format(time.RFC3339))
+
+	targets := verifyTargets(cfg)
+	log.Printf("audit: checking %d converted files", len(targets))
+	var ok, failed, restorable int
+	for i, t := range targets {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		problems, skip := verifyOutput(ctx, cfg, enc, t)
+		if skip {
+			continue
+		}
+		if len(problems) == 0 {
+			ok++
+			fmt.Fprintf(report, "%s\tok\t\t\n", t.path)
+			continue
+		}
+		failed++
+		restore := ""
+		if t.row != nil {
+			if kept := paths.DeleteMePath(t.row.OrigPath); kept != t.path {
+				if _, err := cfg.FS.Stat(kept); err == nil {
+					restore = kept
+					restorable++
+				}
+			}
+		}
+		detail := strings.Join(problems, "; ")
+		fmt.Fprintf(report, "%s\tFAILED\t%s\t%s\n", t.path, strings.Join(strings.Fields(detail), " "), restore)
+		fmt.Fprintf(w, "[%d/%d] FAILED %s: %s\n", i+1, len(targets), t.path, detail)
+		if restore != "" {
+			fmt.Fprintf(w, "        restore from %s\n", restore)
+		}
+	}
+	fmt.Fprintf(w, "\n%d ok, %d failed (%d restorable from _deleteMe originals); report: %s\n",
+		ok, failed, restorable, reportPath)
+	return nil
+}
@@ -2,21 +2,46 @@ package paths
 
 import (
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 )
 
 const (
-	MinSize       int64 = 10 * 1024 * 1024
-	OutputExt           = ".mkv"
-	AV1TmpTag           = ".av1tmp"
-	DeleteMeTag         = "_deleteMe"
-	TmpPrefix           = ".tmp-"
-	LockSuffix          = ".flsq-lock"
-	MetaComment         = "converted to av1 with flicksqueeze"
-	HEVCMetaComment     = "hevc pass by flicksqueeze - av1 pending"
-	TallyFile           = ".flicksqueeze.log"
+	MinSize          int64 = 10 * 1024 * 1024
+	OutputExt              = ".mkv"
+	AV1TmpTag              = ".av1tmp"
+	DeleteMeTag            = "_deleteMe"
+	TmpPrefix              = ".tmp-"
+	LockSuffix             = ".flsq-lock"
+	MetaComment            = "converted to av1 with flicksqueeze"
+	HEVCMetaComment        = "hevc pass by flicksqueeze - av1 pending"
+	TallyFile              = ".flicksqueeze.log"
+	ConfigFile             = ".flicksqueeze.conf"
+	SegmentsSuffix         = ".flsq-segments"
+	SegmentDirTag          = ".tmp-flsq-seg-"
+	OrigTag                = ".flsq-orig"
+	StateDir               = ".flicksqueeze" // per-library state folder (audit records, …)
+	AuditFile              = "conversions.jsonl"
+	ReviewDir              = "review"    // in StateDir: outputs awaiting approval
+	CompareDir             = "compare"   // in StateDir: contact sheets and clips
+	LibraryAuditFile       = "audit.tsv" // in StateDir: report of the audit command
+	MovesFile              = "moves.tsv" // in StateDir: files recognised at a new path
+	PinsFile               = "pins"      // in StateDir: files and folders to convert first
+
+	// Container tags on HEVC pre-pass output linking it to the retained
+	// original (relative to the output's folder, or absolute when archived).
+	OriginalTag      = "FLSQ_ORIGINAL"
+	OriginalCodecTag = "FLSQ_ORIGINAL_CODEC"
+
+	// ModeTag on AV1 output names the rate-control mode it was encoded
+	// with, for restart recovery to record in the tally.
+	ModeTag = "FLSQ_MODE"
+
+	// StageHEVCPending is the pipeline stage of HEVC pre-pass output awaiting
+	// its AV1 encode. It doubles as the cached "codec" in the index.
+	StageHEVCPending = "hevc-pending"
 )
 
 func OutputPath(inPath string) string {
@@ -28,8 +53,71 @@ func OutputPath(inPath string) string {
 	return stem + OutputExt
 }
 
+// InRoot joins a bookkeeping file name onto the library root. SSH/remote
+// roots are Unix-style, so they are joined with path rather than filepath
+// (which would produce backslashes on Windows and break SFTP).
+func InRoot(rootPath, name string) string {
+	if strings.HasPrefix(rootPath, "/") {
+		return path.Join(path.Clean(rootPath), name)
+	}
+	return filepath.Join(rootPath, name)
+}
+
+// Rel is p relative to the library root, with forward slashes. State files
+// record library paths this way so they survive the root being spelled
+// differently (relative, another mount point) on a later run.
+func Rel(rootPath, p string) string {
+	rel := strings.TrimLeft(strings.TrimPrefix(p, rootPath), `/\`)
+	return strings.ReplaceAll(rel, `\`, "/")
+}
+
+// DeleteMePath is where --no-delete keeps an original after conversion.
+func DeleteMePath(inPath string) string {
+	ext := filepath.Ext(inPath)
+	return inPath[:len(inPath)-len(ext)] + DeleteMeTag + ext
+}
+
+// InState joins a file name onto the library's state folder.
+func InState(rootPath, name string) string {
+	return InRoot(rootPath, StateDir+"/"+name)
+}
+
+// SegmentManifest is the resume manifest for a segmented encode of inPath.
+// It lives next to the lock file.
+func SegmentManifest(inPath string) string {
+	return inPath + SegmentsSuffix
+}
+
+// SegmentDir is the directory holding the finished segments of an encode
+// whose final output is outPath.
+func SegmentDir(outPath string) string {
+	ext := filepath.Ext(outPath)
+	return outPath[:len(outPath)-len(ext)] + SegmentDirTag + Hostname()
+}
+
+// IsWorkDir reports whether a directory name belongs to an in-progress encode.
+func IsWorkDir(basename string) bool {
+	return strings.Contains(basename, SegmentDirTag)
+}
+
+// RetainedPath is where an original is kept next to its HEVC pre-pass output
+// until the AV1 stage replaces both.
+func RetainedPath(inPath string) string {
+	ext := filepath.Ext(inPath)
+	return inPath[:len(inPath)-len(ext)] + OrigTag + ext
+}
+
+// ResolveLink resolves an OriginalTag value against the file carrying it.
+func ResolveLink(taggedPath, link string) string {
+	if link == "" || strings.HasPrefix(link, "/") || filepath.IsAbs(link) {
+		return link
+	}
+	return taggedPath[:strings.LastIndexAny(taggedPath, `/\`)+1] + link
+}
+
 func IsWorkFile(basename string) bool {
 	return strings.Contains(basename, AV1TmpTag) ||
+		strings.Contains(basename, OrigTag) ||
 		strings.Contains(basename, TmpPrefix) ||
 		strings.Contains(basename, DeleteMeTag)
 }
@@ -12,6 +12,8 @@ import (
 	"github.com/snadrus/flicksqueeze/internal/vfs"
 )
 
+// failuresFile lists one failed path per line, optionally followed by a tab
+// and the reason it failed.
 const failuresFile = ".flicksqueeze.failures"
 
 func failuresPath(rootPath string) string {
@@ -33,9 +35,15 @@ func LoadFailures(fsys vfs.FS, rootPath string) map[string]bool {
 	defer rc.Close()
 	sc := bufio.NewScanner(rc)
 	for sc.Scan() {
-		line := strings.TrimSpace(sc.Text())
-		if line != "" {
-			set[line] = true
+		p, _, _ := strings.Cut(sc.Text(), "\t")
+		if p = strings.TrimSpace(p); p != "" {
+			set[p] = true
+		}
+	}
+	// A failure follows its file when the scanner has seen it move.
+	if moves := LoadMoves(fsys, rootPath); len(moves) > 0 {
+		for p := range set {
+			set[Moved(moves, p)] = true
 		}
 	}
 	if len(set) > 0 {
@@ -46,7 +54,7 @@ func LoadFailures(fsys vfs.FS, rootPath string) map[string]bool {
 
 var failMu sync.Mutex
 
-func MarkFailed(fsys vfs.FS, rootPath, moviePath string) {
+func MarkFailed(fsys vfs.FS, rootPath, moviePath, reason string) {
 	failMu.Lock()
 	defer failMu.Unlock()
 	fp := failuresPath(rootPath)
@@ -55,5 +63,6 @@ func MarkFailed(fsys vfs.FS, rootPath, moviePath string) {
 		return
 	}
 	defer f.Close()
-	f.Write([]byte(moviePath + "\n"))
+	reason = strings.Join(strings.Fields(reason), " ")
+	f.Write([]byte(moviePath + "\t" + reason + "\n"))
 }
@@ -2,25 +2,88 @@ package scanner
 
 import (
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
 	"github.com/snadrus/flicksqueeze/internal/paths"
 	"github.com/snadrus/flicksqueeze/internal/vfs"
 )
 
+// Index format:
+//
+//	v1: codec \t mtime \t size \t path
+//	v2: codec \t mtime \t size \t meta \t path
+//
+// where meta is a JSON FileMeta. v1 files are still read (with empty meta),
+// so upgrading keeps every cached codec; entries without a probe record are
+// probed once more on the next scan.
 const (
-	indexVersion = 1
+	indexVersion = 2
 	indexHeader  = "# flicksqueeze codec index – do not edit | version:"
 )
 
-func indexFile() string { return ".flicksqueeze-" + paths.Hostname() + ".idx" }
-func indexTmp() string  { return ".flicksqueeze-" + paths.Hostname() + ".idx.tmp" }
+func indexFile() string    { return ".flicksqueeze-" + paths.Hostname() + ".idx" }
+func indexTmp() string     { return ".flicksqueeze-" + paths.Hostname() + ".idx.tmp" }
+func indexJournal() string { return ".flicksqueeze-" + paths.Hostname() + ".idx.journal" }
+
+// IndexPath is this host's index file in rootPath.
+func IndexPath(rootPath string) string { return filepath.Join(rootPath, indexFile()) }
+
+// FileMeta is per-file data cached in the index beyond the codec.
+type FileMeta struct {
+	FP    string                 `json:"fp,omitempty"` // content fingerprint, see Fingerprint
+	Video *VideoMeta             `json:"video,omitempty"`
+	Probe *ffmpeglib.ProbeRecord `json:"probe,omitempty"`
+	Pred  *Prediction            `json:"pred,omitempty"`
+}
+
+// VideoMeta is the primary video stream as probed during the scan.
+type VideoMeta struct {
+	Width    int     `json:"w"`
+	Height   int     `json:"h"`
+	FPS      float64 `json:"fps"`
+	Duration float64 `json:"dur"` // seconds
+	Bitrate  int64   `json:"br"`  // video bits/s, 0 if unknown
+}
+
+// Prediction is the outcome of a preflight sample encode.
+type Prediction struct {
+	Ratio float64 `json:"ratio"` // predicted savings; negative if the output would grow
+	Hours float64 `json:"hours"` // predicted encode wall time
+}
+
+func (m FileMeta) encode() string {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// merge fills fields of m that are unset from o.
+func (m *FileMeta) merge(o FileMeta) {
+	if m.FP == "" {
+		m.FP = o.FP
+	}
+	if m.Video == nil {
+		m.Video = o.Video
+	}
+	if m.Probe == nil {
+		m.Probe = o.Probe
+	}
+	if m.Pred == nil {
+		m.Pred = o.Pred
+	}
+}
 
 func pathKey(p string) string {
 	return strings.ReplaceAll(p, string(filepath.Separator), "\x00")
@@ -31,6 +94,7 @@ func pathKey(p string) string {
 type idxReader struct {
 	rc      io.Closer
 	sc      *bufio.Scanner
+	version int
 	curPath string
 	cur     *idxEntry
 }
@@ -39,6 +103,7 @@ type idxEntry struct {
 	codec   string
 	modTime time.Time
 	size    int64
+	meta    FileMeta
 }
 
 func openReader(fsys vfs.FS, path string) *idxReader {
@@ -61,12 +126,15 @@ func openReader(fsys vfs.FS, path string) *idxReader {
 		return &idxReader{}
 	}
 	ver, err := strconv.Atoi(strings.TrimSpace(parts[1]))
-	if err != nil || ver != indexVersion {
+	if err != nil || ver < 1 || ver > indexVersion {
 		rc.Close()
 		return &idxReader{}
 	}
+	if ver < indexVersion {
+		log.Printf("index: migrating %s from version %d to %d", path, ver, indexVersion)
+	}
 
-	r := &idxReader{rc: rc, sc: sc}
+	r := &idxReader{rc: rc, sc: sc, version: ver}
 	r.next()
 	return r
 }
@@ -82,8 +150,12 @@ func (r *idxReader) next() {
 		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
-		fields := strings.SplitN(line, "\t", 4)
-		if len(fields) != 4 {
+		n := 4
+		if r.version >= 2 {
+			n = 5
+		}
+		fields := strings.SplitN(line, "\t", n)
+		if len(fields) != n {
 			continue
 		}
 		modUnix, err1 := strconv.ParseInt(fields[1], 10, 64)
@@ -91,30 +163,36 @@ func (r *idxReader) next() {
 		if err1 != nil || err2 != nil {
 			continue
 		}
-		r.curPath = fields[3]
-		r.cur = &idxEntry{
+		e := &idxEntry{
 			codec:   fields[0],
 			modTime: time.Unix(modUnix, 0),
 			size:    size,
 		}
+		if n == 5 {
+			if err := json.Unmarshal([]byte(fields[3]), &e.meta); err != nil {
+				e.meta = FileMeta{}
+			}
+		}
+		r.curPath = fields[n-1]
+		r.cur = e
 		return
 	}
 }
 
-func (r *idxReader) advanceTo(path string, modTime time.Time, size int64) (codec string, hit bool) {
+func (r *idxReader) advanceTo(path string, modTime time.Time, size int64) (codec string, meta FileMeta, hit bool) {
 	key := pathKey(path)
 	for r.cur != nil && pathKey(r.curPath) < key {
 		r.next()
 	}
 	if r.cur == nil || r.curPath != path {
-		return "", false
+		return "", FileMeta{}, false
 	}
 	e := r.cur
 	r.next()
 	if e.size == size && e.modTime.Equal(modTime.Truncate(time.Second)) {
-		return e.codec, true
+		return e.codec, e.meta, true
 	}
-	return "", false
+	return "", FileMeta{}, false
 }
 
 func (r *idxReader) close() {
@@ -123,6 +201,48 @@ func (r *idxReader) close() {
 	}
 }
 
+// IndexEntry is one file cached in the index.
+type IndexEntry struct {
+	Path    string
+	Codec   string
+	ModTime time.Time
+	Size    int64
+	Meta    FileMeta
+}
+
+// LoadIndex returns every file cached in this host's index, in path order.
+func LoadIndex(fsys vfs.FS, rootPath string) []IndexEntry {
+	p, _ := currentIndex(fsys, rootPath)
+	if p == "" {
+		return nil
+	}
+	return readIndex(fsys, p)
+}
+
+// readIndex returns the readable entries of the index file at p, in file
+// order.
+func readIndex(fsys vfs.FS, p string) []IndexEntry {
+	r := openReader(fsys, p)
+	defer r.close()
+	var out []IndexEntry
+	for ; r.cur != nil; r.next() {
+		out = append(out, IndexEntry{Path: r.curPath, Codec: r.cur.codec, ModTime: r.cur.modTime, Size: r.cur.size, Meta: r.cur.meta})
+	}
+	return out
+}
+
+// IndexedAs returns the paths the index caches with the given codec (e.g.
+// "flicksqueeze" for our own outputs).
+func IndexedAs(fsys vfs.FS, rootPath, codec string) []string {
+	var out []string
+	for _, e := range LoadIndex(fsys, rootPath) {
+		if e.Codec == codec {
+			out = append(out, e.Path)
+		}
+	}
+	return out
+}
+
 // ---------------- writer ----------------
 
 type idxWriter struct {
@@ -141,8 +261,8 @@ func openWriter(fsys vfs.FS, path string) (*idxWriter, error) {
 	return &idxWriter{wc: wc, w: w}, nil
 }
 
-func (iw *idxWriter) write(path, codec string, modTime time.Time, size int64) {
-	fmt.Fprintf(iw.w, "%s\t%d\t%d\t%s\n", codec, modTime.Truncate(time.Second).Unix(), size, path)
+func (iw *idxWriter) write(path, codec string, meta FileMeta, modTime time.Time, size int64) {
+	fmt.Fprintf(iw.w, "%s\t%d\t%d\t%s\t%s\n", codec, modTime.Truncate(time.Second).Unix(), size, meta.encode(), path)
 	iw.n++
 }
 
@@ -156,25 +276,44 @@ func (iw *idxWriter) close() error {
 
 // ---------------- lifecycle ----------------
 
-func prepareIndex(fsys vfs.FS, rootPath string) (tmpPath, newPath string) {
-	newPath = filepath.Join(rootPath, indexFile())
-	tmpPath = filepath.Join(rootPath, indexTmp())
+// A scan moves the index to its .tmp name and reads it from there while it
+// writes the new index under the proper name, then removes the .tmp. When
+// both files exist, a scan was interrupted (or is running) and the larger of
+// the two is taken as the more complete.
+
+// currentIndex returns this host's index file to read, "" if there is none,
+// and the other file when both exist.
+func currentIndex(fsys vfs.FS, rootPath string) (cur, other string) {
+	newPath := filepath.Join(rootPath, indexFile())
+	tmpPath := filepath.Join(rootPath, indexTmp())
 
 	baseInfo, baseErr := fsys.Stat(newPath)
 	tmpInfo, tmpErr := fsys.Stat(tmpPath)
 
 	switch {
 	case baseErr != nil && tmpErr != nil:
+		return "", ""
 	case baseErr != nil:
+		return tmpPath, ""
 	case tmpErr != nil:
-		fsys.Rename(newPath, tmpPath)
+		return newPath, ""
+	case baseInfo.Size() >= tmpInfo.Size():
+		return newPath, tmpPath
 	default:
-		if baseInfo.Size() >= tmpInfo.Size() {
-			fsys.Remove(tmpPath)
-			fsys.Rename(newPath, tmpPath)
-		} else {
-			fsys.Remove(newPath)
-		}
+		return tmpPath, newPath
+	}
+}
+
+func prepareIndex(fsys vfs.FS, rootPath string) (tmpPath, newPath string) {
+	newPath = filepath.Join(rootPath, indexFile())
+	tmpPath = filepath.Join(rootPath, indexTmp())
+
+	cur, other := currentIndex(fsys, rootPath)
+	if other != "" {
+		fsys.Remove(other)
+	}
+	if cur == newPath {
+		fsys.Rename(newPath, tmpPath)
 	}
 
 	return tmpPath, newPath
@@ -184,3 +323,104 @@ func finishIndex(fsys vfs.FS, tmpPath string, written int) {
 	_ = fsys.Remove(tmpPath)
 	log.Printf("index: saved %d entries", written)
 }
+
+// ---------------- journal ----------------
+//
+// Metadata learned after a file's index line was written (e.g. a preflight
+// prediction) is appended to a per-host journal. The next scan folds it into
+// the index and then drops the journal lines it consumed.
+
+var journalMu sync.Mutex
+
+type journalEntry struct {
+	modTime time.Time
+	size    int64
+	meta    FileMeta
+}
+
+// SavePrediction caches a preflight prediction for path in the index.
+func SavePrediction(fsys vfs.FS, rootPath, path string, size int64, modTime time.Time, pred Prediction) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	f, err := fsys.OpenFile(paths.InRoot(rootPath, indexJournal()), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	meta := FileMeta{Pred: &pred}
+	fmt.Fprintf(f, "%d\t%d\t%s\t%s\n", modTime.Truncate(time.Second).Unix(), size, meta.encode(), path)
+}
+
+// loadJournal returns the journal's entries (latest wins) and its length,
+// so compactJournal can later drop exactly what was read.
+func loadJournal(fsys vfs.FS, rootPath string) (map[string]journalEntry, int) {
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	entries := make(map[string]journalEntry)
+	rc, err := fsys.Open(paths.InRoot(rootPath, indexJournal()))
+	if err != nil {
+		return entries, 0
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return entries, 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, "\t", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		modUnix, err1 := strconv.ParseInt(fields[0], 10, 64)
+		size, err2 := strconv.ParseInt(fields[1], 10, 64)
+		var meta FileMeta
+		if err1 != nil || err2 != nil || json.Unmarshal([]byte(fields[2]), &meta) != nil {
+			continue
+		}
+		e := journalEntry{modTime: time.Unix(modUnix, 0), size: size, meta: meta}
+		if prev, ok := entries[fields[3]]; ok && prev.size == size && prev.modTime.Equal(e.modTime) {
+			e.meta.merge(prev.meta)
+		}
+		entries[fields[3]] = e
+	}
+	return entries, len(data)
+}
+
+// lookupJournal returns journal metadata for path if it still describes the same file.
+func lookupJournal(j map[string]journalEntry, path string, modTime time.Time, size int64) (FileMeta, bool) {
+	e, ok := j[path]
+	if !ok || e.size != size || !e.modTime.Equal(modTime.Truncate(time.Second)) {
+		return FileMeta{}, false
+	}
+	return e.meta, true
+}
+
+// compactJournal removes the first consumed bytes, keeping lines appended
+// while the scan ran.
+func compactJournal(fsys vfs.FS, rootPath string, consumed int) {
+	if consumed == 0 {
+		return
+	}
+	journalMu.Lock()
+	defer journalMu.Unlock()
+	p := paths.InRoot(rootPath, indexJournal())
+	rc, err := fsys.Open(p)
+	if err != nil {
+		return
+	}
+	data, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || len(data) < consumed {
+		return
+	}
+	if len(data) == consumed {
+		_ = fsys.Remove(p)
+		return
+	}
+	wc, err := fsys.Create(p)
+	if err != nil {
+		return
+	}
+	wc.Write(data[consumed:])
+	wc.Close()
+}
@@ -0,0 +1,122 @@
+package scanner
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+func TestReadIndex(t *testing.T) {
+	v1 := indexHeader + " 1\n"
+	v2 := indexHeader + " 2\n"
+	tests := []struct {
+		name   string
+		data   string
+		codecs map[string]string // path -> codec
+		fp     map[string]string // path -> fingerprint
+	}{
+		{
+			name:   "v1 keeps codecs without metadata",
+			data:   v1 + "h264\t100\t2000\t/m/a.mkv\nhevc\t100\t3000\t/m/b.mkv\n",
+			codecs: map[string]string{"/m/a.mkv": "h264", "/m/b.mkv": "hevc"},
+		},
+		{
+			name:   "v2 carries metadata",
+			data:   v2 + "h264\t100\t2000\t{\"fp\":\"abc\"}\t/m/a.mkv\n",
+			codecs: map[string]string{"/m/a.mkv": "h264"},
+			fp:     map[string]string{"/m/a.mkv": "abc"},
+		},
+		{
+			name:   "v2 keeps the codec of unreadable metadata",
+			data:   v2 + "mpeg4\t100\t2000\t{oops\t/m/a.mkv\n",
+			codecs: map[string]string{"/m/a.mkv": "mpeg4"},
+		},
+		{
+			name:   "bad lines are skipped",
+			data:   v2 + "h264\tx\t2000\t{}\t/m/a.mkv\nh264\t100\n\n# note\nvp9\t100\t2000\t{}\t/m/c.mkv\n",
+			codecs: map[string]string{"/m/c.mkv": "vp9"},
+		},
+		{
+			name: "unknown version is ignored",
+			data: indexHeader + " 9\nh264\t100\t2000\t{}\t/m/a.mkv\n",
+		},
+		{
+			name: "no header is ignored",
+			data: "h264\t100\t2000\t/m/a.mkv\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "idx")
+			if err := os.WriteFile(p, []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got := readIndex(vfs.Local{}, p)
+			if len(got) != len(tt.codecs) {
+				t.Fatalf("got %d entries, want %d: %+v", len(got), len(tt.codecs), got)
+			}
+			for _, e := range got {
+				if e.Codec != tt.codecs[e.Path] {
+					t.Errorf("%s: codec %q, want %q", e.Path, e.Codec, tt.codecs[e.Path])
+				}
+				if e.Meta.FP != tt.fp[e.Path] {
+					t.Errorf("%s: fingerprint %q, want %q", e.Path, e.Meta.FP, tt.fp[e.Path])
+				}
+			}
+		})
+	}
+}
+
+func TestIndexMigratesV1(t *testing.T) {
+	root := t.TempDir()
+	codecs := map[string]string{
+		filepath.Join(root, "a.mkv"):        "h264",
+		filepath.Join(root, "b", "b.avi"):   "mpeg4",
+		filepath.Join(root, "b", "c.mkv"):   "flicksqueeze",
+		filepath.Join(root, "gone", "d.ts"): "mpeg2video",
+	}
+	var lines []string
+	for p, codec := range codecs {
+		if !strings.Contains(p, "gone") {
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, []byte("movie"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		lines = append(lines, codec+"\t100\t5\t"+p)
+	}
+	v1 := indexHeader + " 1\n" + strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(IndexPath(root), []byte(v1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	dropped, err := CompactIndex(vfs.Local{}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dropped) != 1 || !strings.Contains(dropped[0], "gone") {
+		t.Errorf("dropped %v, want only the missing file", dropped)
+	}
+
+	rep, err := VerifyIndex(vfs.Local{}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Version != indexVersion || rep.Outdated() || len(rep.Problems) > 0 {
+		t.Errorf("rewritten index: version %d, problems %v", rep.Version, rep.Problems)
+	}
+	entries := LoadIndex(vfs.Local{}, root)
+	if len(entries) != len(codecs)-1 {
+		t.Fatalf("got %d entries, want %d", len(entries), len(codecs)-1)
+	}
+	for _, e := range entries {
+		if e.Codec != codecs[e.Path] {
+			t.Errorf("%s: codec %q, want %q", e.Path, e.Codec, codecs[e.Path])
+		}
+	}
+}
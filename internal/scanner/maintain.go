@@ -0,0 +1,282 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+// Index maintenance: checking the index line by line, dropping entries of
+// files that are gone, and probing chosen files again. Scans skip lines they
+// cannot read, so these are the tools for finding out why a file keeps being
+// probed, or for refreshing data cached by an older ffprobe.
+
+// IndexProblem is something wrong with one line of the index.
+type IndexProblem struct {
+	Line int
+	Msg  string
+}
+
+// IndexReport is what VerifyIndex found.
+type IndexReport struct {
+	Path     string // the index file checked
+	Other    string // the second index file left by an interrupted or running scan, if any
+	Version  int
+	Entries  int
+	Problems []IndexProblem
+}
+
+// Outdated reports whether the next scan will migrate the index.
+func (r IndexReport) Outdated() bool { return r.Version < indexVersion }
+
+// VerifyIndex checks this host's index: its header and version, that every
+// line parses and names a file in the library, and that entries are in the
+// path order scans rely on to match them.
+func VerifyIndex(fsys vfs.FS, rootPath string) (IndexReport, error) {
+	var rep IndexReport
+	rep.Path, rep.Other = currentIndex(fsys, rootPath)
+	if rep.Path == "" {
+		return rep, fmt.Errorf("no index for %s in %s (run a scan first)", paths.Hostname(), rootPath)
+	}
+	rc, err := fsys.Open(rep.Path)
+	if err != nil {
+		return rep, err
+	}
+	defer rc.Close()
+	sc := bufio.NewScanner(rc)
+	sc.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+	problem := func(line int, format string, args ...any) {
+		rep.Problems = append(rep.Problems, IndexProblem{Line: line, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	if !sc.Scan() {
+		problem(1, "empty file")
+		return rep, sc.Err()
+	}
+	head, ver, ok := strings.Cut(sc.Text(), "version:")
+	if !ok || !strings.HasPrefix(head, "# flicksqueeze codec index") {
+		problem(1, "no index header; scans ignore the whole file")
+		return rep, nil
+	}
+	rep.Version, err = strconv.Atoi(strings.TrimSpace(ver))
+	switch {
+	case err != nil:
+		problem(1, "unreadable version %q; scans ignore the whole file", strings.TrimSpace(ver))
+		return rep, nil
+	case rep.Version < 1 || rep.Version > indexVersion:
+		problem(1, "version %d is not one this build reads (1-%d); scans ignore the whole file", rep.Version, indexVersion)
+		return rep, nil
+	}
+
+	fields := 4
+	if rep.Version >= 2 {
+		fields = 5
+	}
+	var prevPath string
+	prevLine := 0
+	for n := 2; sc.Scan(); n++ {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.SplitN(line, "\t", fields)
+		if len(f) != fields {
+			problem(n, "%d tab-separated fields, want %d", len(f), fields)
+			continue
+		}
+		if f[0] == "" {
+			problem(n, "no codec")
+		}
+		if _, err := strconv.ParseInt(f[1], 10, 64); err != nil {
+			problem(n, "bad modification time %q", f[1])
+		}
+		if _, err := strconv.ParseInt(f[2], 10, 64); err != nil {
+			problem(n, "bad size %q", f[2])
+		}
+		if fields == 5 {
+			var meta FileMeta
+			if err := json.Unmarshal([]byte(f[3]), &meta); err != nil {
+				problem(n, "bad metadata: %v", err)
+			}
+		}
+		p := f[fields-1]
+		if !strings.HasPrefix(p, rootPath) {
+			problem(n, "%s is outside %s", p, rootPath)
+		}
+		switch {
+		case prevLine == 0:
+		case p == prevPath:
+			problem(n, "%s is also on line %d", p, prevLine)
+		case pathKey(p) < pathKey(prevPath):
+			problem(n, "%s is out of order after line %d; scans never match it", p, prevLine)
+		}
+		prevPath, prevLine = p, n
+		rep.Entries++
+	}
+	return rep, sc.Err()
+}
+
+// writeIndex replaces this host's index with entries, sorted by path. Of
+// entries for the same path, the first is kept.
+func writeIndex(fsys vfs.FS, rootPath string, entries []IndexEntry) error {
+	sort.SliceStable(entries, func(i, j int) bool { return pathKey(entries[i].Path) < pathKey(entries[j].Path) })
+	tmpPath, newPath := prepareIndex(fsys, rootPath)
+	w, err := openWriter(fsys, newPath)
+	if err != nil {
+		return err
+	}
+	for i, e := range entries {
+		if i > 0 && e.Path == entries[i-1].Path {
+			continue
+		}
+		w.write(e.Path, e.Codec, e.Meta, e.ModTime, e.Size)
+	}
+	if err := w.close(); err != nil {
+		return err
+	}
+	finishIndex(fsys, tmpPath, w.n)
+	return nil
+}
+
+// CompactIndex drops the index entries of files that no longer exist, and
+// rewrites the rest in order without unreadable or repeated lines. It
+// returns the paths dropped.
+func CompactIndex(fsys vfs.FS, rootPath string) ([]string, error) {
+	cur, _ := currentIndex(fsys, rootPath)
+	if cur == "" {
+		return nil, fmt.Errorf("no index for %s in %s (run a scan first)", paths.Hostname(), rootPath)
+	}
+	entries := readIndex(fsys, cur)
+	kept := entries[:0]
+	var dropped []string
+	for _, e := range entries {
+		_, err := fsys.Stat(e.Path)
+		switch {
+		case err == nil:
+			kept = append(kept, e)
+		case errors.Is(err, fs.ErrNotExist):
+			dropped = append(dropped, e.Path)
+		default:
+			return nil, err
+		}
+	}
+	if len(kept) == 0 && len(dropped) > 0 {
+		return nil, fmt.Errorf("none of the %d indexed files exist; is %s mounted?", len(dropped), rootPath)
+	}
+	return dropped, writeIndex(fsys, rootPath, kept)
+}
+
+// RebuildIndex probes again the indexed files in the selected files and
+// folders (relative to the library root, or absolute), and any selected
+// file the index does not have yet, replacing what was cached for them.
+// Predictions are kept for files that have not changed. Files that no longer
+// exist are dropped. batch is how many files one probe command covers. It
+// returns how many files were probed and dropped.
+func RebuildIndex(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, rootPath string, selected []string, batch int) (probed, dropped int, err error) {
+	var dirs []string
+	for _, s := range selected {
+		dir := path.Clean(cleanRel(rootPath, s))
+		if dir == "." {
+			dir = ""
+		}
+		dirs = append(dirs, dir)
+	}
+	chosen := func(p string) bool {
+		rel := paths.Rel(rootPath, p)
+		for _, dir := range dirs {
+			if within(rel, dir) {
+				return true
+			}
+		}
+		return false
+	}
+
+	cur, _ := currentIndex(fsys, rootPath)
+	var entries []IndexEntry
+	if cur != "" {
+		entries = readIndex(fsys, cur)
+	}
+	old := make(map[string]IndexEntry)
+	var keep []IndexEntry
+	for _, e := range entries {
+		if chosen(e.Path) {
+			old[e.Path] = e
+		} else {
+			keep = append(keep, e)
+		}
+	}
+	for i, dir := range dirs {
+		p := paths.InRoot(rootPath, filepath.FromSlash(dir))
+		if _, ok := old[p]; ok {
+			continue
+		}
+		if _, err := fsys.Stat(p); err != nil {
+			if !indexedWithin(old, rootPath, dir) {
+				return 0, 0, fmt.Errorf("%s: %w", selected[i], err)
+			}
+			continue
+		}
+		if movieExtensions[strings.ToLower(filepath.Ext(p))] {
+			old[p] = IndexEntry{Path: p}
+		}
+	}
+
+	var items []*scanItem
+	for p, e := range old {
+		info, err := fsys.Stat(p)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			dropped++
+			continue
+		case err != nil:
+			return 0, 0, err
+		case info.IsDir():
+			continue
+		}
+		it := &scanItem{path: p, mod: info.ModTime(), size: info.Size(), done: make(chan struct{})}
+		if e.Size == it.size && e.ModTime.Equal(it.mod.Truncate(time.Second)) {
+			it.meta.Pred = e.Meta.Pred
+		}
+		items = append(items, it)
+	}
+	for start := 0; start < len(items); start += max(batch, 1) {
+		if err := ctx.Err(); err != nil {
+			return 0, 0, err
+		}
+		identify(ctx, fsys, enc, nil, items[start:min(start+max(batch, 1), len(items))])
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	for _, it := range items {
+		codec := it.codec
+		if it.err != nil {
+			codec = "X"
+		}
+		keep = append(keep, IndexEntry{Path: it.path, Codec: codec, ModTime: it.mod, Size: it.size, Meta: it.meta})
+	}
+	return len(items), dropped, writeIndex(fsys, rootPath, keep)
+}
+
+// indexedWithin reports whether any of entries is in dir.
+func indexedWithin(entries map[string]IndexEntry, rootPath, dir string) bool {
+	for p := range entries {
+		if within(paths.Rel(rootPath, p), dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package scanner
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+// Content identity: the index keeps a fingerprint of every file, so a movie
+// that was renamed or moved is recognised by its content on the next scan.
+// Its cached codec and metadata are carried over, and the move is appended to
+// the library's moves file so that failures and conversion history recorded
+// under the old path follow it.
+
+const fingerprintBlock = 64 << 10
+
+// Fingerprint identifies a file's content by its size and a hash of its
+// first, middle and last 64 KiB, without reading the whole file. It is empty
+// if the file cannot be read at an offset.
+func Fingerprint(fsys vfs.FS, path string, size int64) string {
+	rc, err := fsys.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+	ra, ok := rc.(io.ReaderAt)
+	if !ok {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", size)
+	buf := make([]byte, fingerprintBlock)
+	for _, off := range []int64{0, size/2 - fingerprintBlock/2, size - fingerprintBlock} {
+		n, err := ra.ReadAt(buf, max(off, 0))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return ""
+		}
+		h.Write(buf[:n])
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// indexed is an entry of the previous index, found by fingerprint.
+type indexed struct {
+	path  string
+	codec string
+}
+
+// knownFiles finds the entries of the previous index by fingerprint. Only
+// their paths and codecs are held; the metadata of the few files recognised
+// at a new path is read back from the index.
+type knownFiles struct {
+	fsys  vfs.FS
+	index string
+	byFP  map[string]indexed
+}
+
+// indexedByFingerprint reads the fingerprints of the index at p. Older
+// indexes carry none.
+func indexedByFingerprint(fsys vfs.FS, p string) *knownFiles {
+	known := &knownFiles{fsys: fsys, index: p, byFP: make(map[string]indexed)}
+	rc, err := fsys.Open(p)
+	if err != nil {
+		return known
+	}
+	defer rc.Close()
+	sc := bufio.NewScanner(rc)
+	sc.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+	for sc.Scan() {
+		f := strings.SplitN(sc.Text(), "\t", 5)
+		if len(f) != 5 {
+			continue
+		}
+		var meta struct {
+			FP string `json:"fp"`
+		}
+		if json.Unmarshal([]byte(f[3]), &meta) == nil && meta.FP != "" {
+			known.byFP[meta.FP] = indexed{path: f[4], codec: f[0]}
+		}
+	}
+	return known
+}
+
+// meta reads the metadata the index holds for path.
+func (k *knownFiles) meta(path string) FileMeta {
+	rc, err := k.fsys.Open(k.index)
+	if err != nil {
+		return FileMeta{}
+	}
+	defer rc.Close()
+	sc := bufio.NewScanner(rc)
+	sc.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+	for sc.Scan() {
+		f := strings.SplitN(sc.Text(), "\t", 5)
+		if len(f) != 5 || f[4] != path {
+			continue
+		}
+		var meta FileMeta
+		if json.Unmarshal([]byte(f[3]), &meta) == nil {
+			return meta
+		}
+		break
+	}
+	return FileMeta{}
+}
+
+// recognise carries over what the previous index knew about the file's
+// content when it was indexed under another path. The old path still
+// existing makes the file a copy rather than a move.
+func (it *scanItem) recognise(fsys vfs.FS, known *knownFiles) {
+	if known == nil {
+		return
+	}
+	old, ok := known.byFP[it.meta.FP]
+	if !ok || old.path == it.path {
+		return
+	}
+	fp := it.meta.FP
+	it.hit, it.codec, it.meta = true, old.codec, known.meta(old.path)
+	it.meta.FP = fp
+	it.from = old.path
+	_, err := fsys.Stat(old.path)
+	it.moved = errors.Is(err, fs.ErrNotExist)
+}
+
+var movesMu sync.Mutex
+
+// recordMove appends a move to the library's moves file: time, old path and
+// new path, tab-separated.
+func recordMove(fsys vfs.FS, rootPath, from, to string) {
+	movesMu.Lock()
+	defer movesMu.Unlock()
+	if err := fsys.MkdirAll(paths.InRoot(rootPath, paths.StateDir), 0o755); err != nil {
+		return
+	}
+	f, err := fsys.OpenFile(paths.InState(rootPath, paths.MovesFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s\t%s\t%s\n", time.Now().Format(time.RFC3339), from, to)
+}
+
+// LoadMoves returns the library's recorded moves, old path to new.
+func LoadMoves(fsys vfs.FS, rootPath string) map[string]string {
+	moves := make(map[string]string)
+	rc, err := fsys.Open(paths.InState(rootPath, paths.MovesFile))
+	if err != nil {
+		return moves
+	}
+	defer rc.Close()
+	sc := bufio.NewScanner(rc)
+	for sc.Scan() {
+		parts := strings.Split(sc.Text(), "\t")
+		if len(parts) != 3 || parts[1] == parts[2] {
+			continue
+		}
+		moves[parts[1]] = parts[2]
+		delete(moves, parts[2]) // a file moved back is at its old path again
+	}
+	return moves
+}
+
+// Moved follows recorded moves from p to the file's current path.
+func Moved(moves map[string]string, p string) string {
+	for range len(moves) {
+		to, ok := moves[p]
+		if !ok {
+			break
+		}
+		p = to
+	}
+	return p
+}
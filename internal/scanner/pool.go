@@ -0,0 +1,172 @@
+package scanner
+
+import (
+	"container/heap"
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Candidates wait in a priority heap between the walk and the consumer. The
+// consumer gets the best one found so far whenever it is ready for another,
+// and a better candidate found later overtakes those still waiting.
+
+// pinRecheck is how often waiting candidates are re-ranked against the pins.
+const pinRecheck = 15 * time.Second
+
+// ahead reports whether a goes before b: pinned candidates first, in pin
+// order, then by rank.
+func ahead(a, b Candidate) bool {
+	if (a.Pin > 0) != (b.Pin > 0) {
+		return a.Pin > 0
+	}
+	if a.Pin != b.Pin {
+		return a.Pin < b.Pin
+	}
+	if a.Rank != b.Rank {
+		return a.Rank > b.Rank
+	}
+	return a.Path < b.Path
+}
+
+type candHeap []Candidate
+
+func (h candHeap) Len() int           { return len(h) }
+func (h candHeap) Less(i, j int) bool { return ahead(h[i], h[j]) }
+func (h candHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *candHeap) Push(x any)        { *h = append(*h, x.(Candidate)) }
+func (h *candHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// pool holds a scan's candidates until they are handed out.
+type pool struct {
+	mu      sync.Mutex
+	rank    *ranker
+	heap    candHeap
+	changed chan struct{} // a candidate was added
+	walked  chan struct{} // closed when the walk is done
+}
+
+func newPool(rank *ranker) *pool {
+	return &pool{
+		rank:    rank,
+		changed: make(chan struct{}, 1),
+		walked:  make(chan struct{}),
+	}
+}
+
+// offer ranks c and adds it, unless its folder weight is 0 and it is not
+// pinned. It returns the ranked candidate and whether it was added.
+func (p *pool) offer(c Candidate) (Candidate, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rank.apply(&c) == 0 && c.Pin == 0 {
+		return c, false
+	}
+	heap.Push(&p.heap, c)
+	select {
+	case p.changed <- struct{}{}:
+	default:
+	}
+	return c, true
+}
+
+// pinned reports whether the file at path is pinned.
+func (p *pool) pinned(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.rank.pinned(path)
+}
+
+// snapshot returns the waiting candidates, best first.
+func (p *pool) snapshot() []Candidate {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cs := slices.Clone(p.heap)
+	SortCandidates(cs)
+	return cs
+}
+
+// finish marks the walk done: serve stops waiting for more candidates.
+func (p *pool) finish() { close(p.walked) }
+
+// repin re-ranks the waiting candidates if the pins have changed.
+// p.mu must be held.
+func (p *pool) repin() {
+	pins := p.rank.pins
+	p.rank.refresh()
+	if slices.Equal(pins, p.rank.pins) {
+		return
+	}
+	for i := range p.heap {
+		p.rank.apply(&p.heap[i])
+	}
+	heap.Init(&p.heap)
+}
+
+// take removes the candidate at path, which was at the top when last looked
+// at but may have been overtaken since. p.mu must be held.
+func (p *pool) take(path string) {
+	for i := range p.heap {
+		if p.heap[i].Path == path {
+			heap.Remove(&p.heap, i)
+			return
+		}
+	}
+}
+
+// serve hands the best waiting candidate to out whenever the consumer is
+// ready, until the walk is done and nothing waits, or ctx ends. The first
+// candidate waits for warmUp to pass or the walk to finish, whichever comes
+// first: a longer warm-up surveys more of the library before the first
+// pick, a shorter one starts encoding sooner.
+func (p *pool) serve(ctx context.Context, out chan<- Candidate, warmUp time.Duration) {
+	warm := time.NewTimer(warmUp)
+	defer warm.Stop()
+	select {
+	case <-warm.C:
+	case <-p.walked:
+	case <-ctx.Done():
+		return
+	}
+
+	tick := time.NewTicker(pinRecheck)
+	defer tick.Stop()
+	walked := p.walked
+	for {
+		p.mu.Lock()
+		var best Candidate
+		send := out
+		if len(p.heap) > 0 {
+			best = p.heap[0]
+		} else if walked == nil {
+			p.mu.Unlock()
+			return
+		} else {
+			send = nil
+		}
+		p.mu.Unlock()
+
+		select {
+		case send <- best:
+			p.mu.Lock()
+			p.take(best.Path)
+			p.repin()
+			p.mu.Unlock()
+		case <-p.changed:
+		case <-walked:
+			walked = nil
+		case <-tick.C:
+			p.mu.Lock()
+			p.repin()
+			p.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
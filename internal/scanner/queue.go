@@ -0,0 +1,149 @@
+package scanner
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+// Queue is the ranked list of candidates the last scan found, kept per host
+// in the state folder so that a restart resumes converting right away
+// instead of waiting for a full walk. A scan replaces it when its walk
+// completes; candidates leave it once they have been processed, whatever the
+// outcome.
+type Queue struct {
+	mu       sync.Mutex
+	fsys     vfs.FS
+	rootPath string
+	rank     *ranker
+	items    []Candidate
+	taken    map[string]bool
+}
+
+func queueFile() string { return "queue-" + paths.Hostname() + ".jsonl" }
+
+// OpenQueue loads the library's stored queue; it is empty if there is none.
+func OpenQueue(fsys vfs.FS, rootPath string, weights map[string]float64) *Queue {
+	q := &Queue{
+		fsys:     fsys,
+		rootPath: rootPath,
+		rank:     newRanker(fsys, rootPath, weights),
+		taken:    make(map[string]bool),
+	}
+	rc, err := fsys.Open(paths.InState(rootPath, queueFile()))
+	if err != nil {
+		return q
+	}
+	defer rc.Close()
+	sc := bufio.NewScanner(rc)
+	sc.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+	for sc.Scan() {
+		var c Candidate
+		if json.Unmarshal(sc.Bytes(), &c) == nil && c.Path != "" {
+			q.items = append(q.items, c)
+		}
+	}
+	return q
+}
+
+// Len is the number of candidates waiting, including one being processed.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// Candidates returns the candidates waiting, including those handed out.
+func (q *Queue) Candidates() []Candidate {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Candidate(nil), q.items...)
+}
+
+// Next returns the best-ranked candidate not yet handed out, ranked with the
+// current pins.
+func (q *Queue) Next() (Candidate, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rank.refresh()
+	q.rank.sort(q.items)
+	for _, c := range q.items {
+		if !q.taken[c.Path] {
+			q.taken[c.Path] = true
+			return c, true
+		}
+	}
+	return Candidate{}, false
+}
+
+// Done drops the candidate at path from the queue.
+func (q *Queue) Done(path string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.taken, path)
+	for i, c := range q.items {
+		if c.Path == path {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.save()
+			return
+		}
+	}
+}
+
+// replace makes a completed walk's candidates the queue.
+func (q *Queue) replace(cs []Candidate) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append([]Candidate(nil), cs...)
+	q.taken = make(map[string]bool)
+	q.save()
+}
+
+// save writes the queue to a temporary file and renames it into place, so
+// that a crash or a full disk never leaves a truncated queue behind.
+func (q *Queue) save() {
+	if err := q.write(); err != nil {
+		log.Printf("queue: %v", err)
+	}
+}
+
+func (q *Queue) write() error {
+	if err := q.fsys.MkdirAll(paths.InRoot(q.rootPath, paths.StateDir), 0o755); err != nil {
+		return err
+	}
+	path := paths.InState(q.rootPath, queueFile())
+	tmp := path + ".tmp"
+	f, err := q.fsys.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, c := range q.items {
+		if err := enc.Encode(c); err != nil {
+			f.Close()
+			q.fsys.Remove(tmp)
+			return fmt.Errorf("%s: %w", c.Path, err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		q.fsys.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		q.fsys.Remove(tmp)
+		return err
+	}
+	// SFTP will not rename over an existing file.
+	if err := q.fsys.Rename(tmp, path); err != nil {
+		q.fsys.Remove(path)
+		return q.fsys.Rename(tmp, path)
+	}
+	return nil
+}
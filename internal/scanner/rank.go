@@ -0,0 +1,187 @@
+package scanner
+
+import (
+	"bufio"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+// Ranking beyond waste: folder weights from the library settings scale a
+// candidate's score, and pinned files or folders go before everything else,
+// in the order they were pinned. Pins live in the state folder, one path
+// relative to the library root per line, so they can be edited by hand or
+// from the console while flicksqueeze runs.
+
+// ranker orders candidates by pins and folder weights. Folders and pins are
+// relative to the library root, with forward slashes.
+type ranker struct {
+	fsys     vfs.FS
+	rootPath string
+	weights  map[string]float64
+	pins     []string
+}
+
+func newRanker(fsys vfs.FS, rootPath string, weights map[string]float64) *ranker {
+	r := &ranker{fsys: fsys, rootPath: rootPath, weights: make(map[string]float64)}
+	for dir, w := range weights {
+		r.weights[cleanRel(rootPath, dir)] = w
+	}
+	r.refresh()
+	return r
+}
+
+// refresh rereads the pins, which may change while a scan's candidates wait.
+func (r *ranker) refresh() {
+	r.pins = LoadPins(r.fsys, r.rootPath)
+}
+
+// cleanRel turns a configured folder or pin into a path relative to the
+// library root.
+func cleanRel(rootPath, p string) string {
+	p = strings.TrimSpace(p)
+	root := strings.TrimRight(rootPath, `/\`)
+	if rest, ok := strings.CutPrefix(p, root); ok && (rest == "" || rest[0] == '/' || rest[0] == '\\') {
+		p = rest
+	}
+	return strings.Trim(strings.ReplaceAll(p, `\`, "/"), "/")
+}
+
+// pinned reports whether the file at path is pinned.
+func (r *ranker) pinned(path string) bool {
+	rel := paths.Rel(r.rootPath, path)
+	for _, pin := range r.pins {
+		if within(rel, pin) {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether rel is dir or inside it. The empty dir is the
+// library root.
+func within(rel, dir string) bool {
+	return dir == "" || rel == dir || strings.HasPrefix(rel, dir+"/")
+}
+
+// apply sets c's rank and explains it. The deepest weighted folder holding
+// the file sets its multiplier; weight is it, 1 when no folder matches.
+func (r *ranker) apply(c *Candidate) (weight float64) {
+	rel := paths.Rel(r.rootPath, c.Path)
+	weight, deepest := 1, -1
+	var folder string
+	for dir, w := range r.weights {
+		if within(rel, dir) && len(dir) > deepest {
+			weight, deepest, folder = w, len(dir), dir
+		}
+	}
+	c.Rank = c.WasteScore * weight
+	c.Pin = 0
+	c.RankWhy = ""
+	if deepest >= 0 {
+		c.RankWhy = fmt.Sprintf("folder weight x%g (%s/)", weight, folder)
+	}
+	for i, pin := range r.pins {
+		if within(rel, pin) {
+			c.Pin = i + 1
+			c.RankWhy = fmt.Sprintf("pinned #%d (%s)", c.Pin, pin)
+			break
+		}
+	}
+	return weight
+}
+
+// sort reapplies the ranking to cs and sorts them best first.
+func (r *ranker) sort(cs []Candidate) {
+	for i := range cs {
+		r.apply(&cs[i])
+	}
+	SortCandidates(cs)
+}
+
+// SortCandidates orders candidates for conversion: pinned ones first, in pin
+// order, then by rank.
+func SortCandidates(cs []Candidate) {
+	sort.Slice(cs, func(i, j int) bool { return ahead(cs[i], cs[j]) })
+}
+
+var pinsMu sync.Mutex
+
+// LoadPins returns the library's pins, relative to its root, in pin order.
+func LoadPins(fsys vfs.FS, rootPath string) []string {
+	rc, err := fsys.Open(paths.InState(rootPath, paths.PinsFile))
+	if err != nil {
+		return nil
+	}
+	defer rc.Close()
+	var pins []string
+	sc := bufio.NewScanner(rc)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pins = append(pins, cleanRel(rootPath, line))
+	}
+	return pins
+}
+
+// Pin adds a file or folder to the end of the library's pins.
+func Pin(fsys vfs.FS, rootPath, p string) error {
+	pinsMu.Lock()
+	defer pinsMu.Unlock()
+	rel := cleanRel(rootPath, p)
+	if rel == "" {
+		return fmt.Errorf("cannot pin the whole library")
+	}
+	if _, err := fsys.Stat(paths.InRoot(rootPath, filepath.FromSlash(rel))); err != nil {
+		return err
+	}
+	pins := LoadPins(fsys, rootPath)
+	for _, have := range pins {
+		if have == rel {
+			return nil
+		}
+	}
+	return savePins(fsys, rootPath, append(pins, rel))
+}
+
+// Unpin removes a file or folder from the library's pins.
+func Unpin(fsys vfs.FS, rootPath, p string) error {
+	pinsMu.Lock()
+	defer pinsMu.Unlock()
+	rel := cleanRel(rootPath, p)
+	pins := LoadPins(fsys, rootPath)
+	kept := pins[:0]
+	for _, have := range pins {
+		if have != rel {
+			kept = append(kept, have)
+		}
+	}
+	if len(kept) == len(pins) {
+		return fmt.Errorf("%s is not pinned", rel)
+	}
+	return savePins(fsys, rootPath, kept)
+}
+
+func savePins(fsys vfs.FS, rootPath string, pins []string) error {
+	if err := fsys.MkdirAll(paths.InRoot(rootPath, paths.StateDir), 0o755); err != nil {
+		return err
+	}
+	f, err := fsys.Create(paths.InState(rootPath, paths.PinsFile))
+	if err != nil {
+		return err
+	}
+	for _, p := range pins {
+		if _, err := fmt.Fprintln(f, p); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
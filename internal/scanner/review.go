@@ -0,0 +1,45 @@
+package scanner
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"strings"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+// PendingReviews returns the paths, relative to the library root with
+// forward slashes, of files whose conversion is parked in the review folder
+// awaiting approval. Each pending conversion is described by a JSON file
+// there whose "path" names the file it would replace.
+func PendingReviews(fsys vfs.FS, rootPath string) map[string]bool {
+	set := make(map[string]bool)
+	dir := paths.InState(rootPath, paths.ReviewDir)
+	if _, err := fsys.Stat(dir); err != nil {
+		return set
+	}
+	_ = fsys.Walk(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(p, ".json") {
+			return nil
+		}
+		rc, err := fsys.Open(p)
+		if err != nil {
+			return nil
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			return nil
+		}
+		var item struct {
+			Path string `json:"path"`
+		}
+		if json.Unmarshal(data, &item) == nil && item.Path != "" {
+			set[item.Path] = true
+		}
+		return nil
+	})
+	return set
+}
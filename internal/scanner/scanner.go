@@ -6,19 +6,17 @@ import (
 	"io/fs"
 	"log"
 	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/snadrus/flicksqueeze/internal/config"
 	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
 	"github.com/snadrus/flicksqueeze/internal/paths"
 	"github.com/snadrus/flicksqueeze/internal/vfs"
 )
 
-const (
-	flushEvery = 1000
-	staleAge   = 3 * 24 * time.Hour
-)
+const staleAge = 3 * 24 * time.Hour
 
 var movieExtensions = map[string]bool{
 	".mp4": true, ".mkv": true, ".avi": true, ".mov": true,
@@ -63,39 +61,141 @@ type Candidate struct {
 	Size       int64
 	Codec      string
 	WasteScore float64
+
+	// Stage is "" for ordinary sources and paths.StageHEVCPending for HEVC
+	// pre-pass output. Such output may link to its retained original
+	// (Source), which the AV1 stage encodes from instead of Path.
+	Stage       string
+	Source      string
+	SourceCodec string
+	SourceSize  int64
+
+	Meta FileMeta // cached per-file data from the index
+	Why  string   // how WasteScore was derived
+
+	// Rank is WasteScore scaled by the folder weight; Pin is the 1-based
+	// position of the pin covering the file, 0 if none. RankWhy explains
+	// both when either applies.
+	Rank    float64
+	Pin     int
+	RankWhy string
+}
+
+// EncodeInput is the file the next encode should read.
+func (c Candidate) EncodeInput() string {
+	if c.Source != "" {
+		return c.Source
+	}
+	return c.Path
+}
+
+// EncodeSize is the size of EncodeInput, which the output must undercut.
+func (c Candidate) EncodeSize() int64 {
+	if c.Source != "" {
+		return c.SourceSize
+	}
+	return c.Size
+}
+
+// Options tunes a scan.
+type Options struct {
+	Verbose    bool    // log why each skipped file is excluded
+	Mode       string  // AV1 rate-control mode; selects the matching tally savings
+	MinSavings float64 // skip files whose cached preflight predicts less savings
+
+	// HEVCFirst lists the codecs the hardware HEVC pre-pass converts first;
+	// their tally savings are those of hardware encodes. Nil without the
+	// hardware.
+	HEVCFirst map[string]bool
+
+	// FolderWeights scales the waste score of files in a folder (relative
+	// to the library root); 0 leaves the folder out.
+	FolderWeights map[string]float64
+
+	// ProbeWorkers bounds how many probes run at once; each covers up to
+	// ProbeBatch files in one ffprobe command (see ffmpeglib.ProbeBatch).
+	ProbeWorkers int
+	ProbeBatch   int
+
+	// WarmUp is how long candidates gather before the first is handed out;
+	// the walk finishing ends it early.
+	WarmUp time.Duration
+
+	// Queue, when set, is replaced with the candidates of a completed walk.
+	Queue *Queue
+
+	// Archive is the folder originals wait in between the HEVC pre-pass and
+	// the AV1 stage; the walk leaves it out.
+	Archive string
+
+	// Indexed, when set, is called once the scan is done with the index,
+	// before Scan waits for its last candidates to be handed out.
+	Indexed func()
+}
+
+// encodeMode is the tally mode a file of codec will be encoded with next.
+func (o Options) encodeMode(codec string) string {
+	if o.HEVCFirst[strings.ToLower(codec)] {
+		return config.ModeHW
+	}
+	return o.Mode
 }
 
-// savingsRatio returns expected savings [0,1]. Tally overrides codecSavings when present.
-func savingsRatio(codec string, tally map[string]float64) float64 {
+// savingsRatio returns expected savings [0,1]. Tally overrides codecSavings when
+// it has results for the same codec and rate-control mode, or else for the
+// codec in any mode.
+func savingsRatio(codec, mode string, tally map[string]float64) float64 {
+	if r, ok := tallyRatio(codec, mode, tally); ok {
+		return r
+	}
+	return priorRatio(codec)
+}
+
+// tallyRatio is the mean savings past encodes of codec achieved, in mode if
+// there are any, else in any mode. Zero is a result too: every attempt
+// failed or none shrank.
+func tallyRatio(codec, mode string, tally map[string]float64) (float64, bool) {
 	c := strings.ToLower(codec)
-	if tally != nil {
-		if r, ok := tally[c]; ok && r > 0 {
-			return r
-		}
+	if r, ok := tally[TallyKey(c, mode)]; ok {
+		return r, true
 	}
-	if r, ok := codecSavings[c]; ok {
+	r, ok := tally[c]
+	return r, ok
+}
+
+// priorRatio is the savings expected of codec before any tally results.
+func priorRatio(codec string) float64 {
+	if r, ok := codecSavings[strings.ToLower(codec)]; ok {
 		return r
 	}
 	return 0.50 // unknown codec
 }
 
 // Scan walks rootPath, streaming up to MaxCandidates candidates on out.
-// If verbose is true, logs why each skipped file is excluded.
-func Scan(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, rootPath string, out chan<- Candidate, verbose bool) {
+func Scan(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, rootPath string, out chan<- Candidate, opts Options) {
 	defer close(out)
+	indexed := sync.OnceFunc(func() {
+		if opts.Indexed != nil {
+			opts.Indexed()
+		}
+	})
+	defer indexed()
 
 	skipLog := func(path, reason string) {
-		if verbose {
+		if opts.Verbose {
 			log.Printf("scan: skipping %s (%s)", path, reason)
 		}
 	}
 
 	cutoff := time.Now().Add(-staleAge)
 	failures := LoadFailures(fsys, rootPath)
+	reviews := PendingReviews(fsys, rootPath)
 	tally := LoadTally(fsys, filepath.Join(rootPath, paths.TallyFile))
 
+	journal, journalLen := loadJournal(fsys, rootPath)
 	tmpPath, newPath := prepareIndex(fsys, rootPath)
 	reader := openReader(fsys, tmpPath)
+	known := indexedByFingerprint(fsys, tmpPath)
 	defer reader.close()
 
 	writer, err := openWriter(fsys, newPath)
@@ -104,21 +204,156 @@ func Scan(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, rootPath str
 		return
 	}
 
-	var buf []Candidate
 	scanned := 0
+	ready := newPool(newRanker(fsys, rootPath, opts.FolderWeights))
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		ready.serve(ctx, out, opts.WarmUp)
+	}()
+	defer func() { <-served }()
 	writerOK := true
 
-	enqueue := func(path, codec string, sz int64) {
-		savings := savingsRatio(codec, tally)
-		buf = append(buf, Candidate{
-			Path:       path,
-			Size:       sz,
-			Codec:      codec,
-			WasteScore: float64(sz) * savings,
-		})
+	// Pinned files are queued even when they do not look worth converting.
+	enqueue := func(path, codec string, sz int64, meta FileMeta) {
+		pinned := ready.pinned(path)
+		if p := meta.Pred; p != nil && p.Ratio < opts.MinSavings && !pinned {
+			skipLog(path, fmt.Sprintf("preflight predicts %.0f%% savings", p.Ratio*100))
+			return
+		}
+		var c Candidate
+		if codec == paths.StageHEVCPending {
+			c = pendingCandidate(ctx, fsys, enc, path, sz, meta, opts.Mode, tally)
+		} else {
+			waste, why, ok := score(codec, sz, meta, opts.encodeMode(codec), tally)
+			if !ok && !pinned {
+				skipLog(path, "already efficient: "+why)
+				return
+			}
+			c = Candidate{
+				Path:       path,
+				Size:       sz,
+				Codec:      codec,
+				WasteScore: waste,
+				Why:        why,
+			}
+		}
+		c.Meta = meta
+		if c, ok := ready.offer(c); !ok {
+			skipLog(path, c.RankWhy)
+			return
+		}
 		scanned++
-		if scanned%flushEvery == 0 {
-			tryFlushBest(ctx, &buf, out)
+	}
+
+	// Files are probed concurrently but settled (indexed and ranked) in walk
+	// order, which keeps the new index sorted for the next scan's reader.
+	sem := make(chan struct{}, max(opts.ProbeWorkers, 1))
+	var pending, batch []*scanItem
+
+	dispatch := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		b := batch
+		batch = nil
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			for _, it := range b {
+				close(it.done)
+			}
+			return ctx.Err()
+		}
+		go func() {
+			defer func() { <-sem }()
+			identify(ctx, fsys, enc, known, b)
+		}()
+		return nil
+	}
+
+	settle := func(it *scanItem) {
+		path, sz := it.path, it.size
+		if it.moved {
+			recordMove(fsys, rootPath, it.from, path)
+			if opts.Verbose {
+				log.Printf("scan: %s moved to %s", it.from, path)
+			}
+			if failures[it.from] {
+				failures[path] = true
+				writer.write(path, it.codec, it.meta, it.mod, sz)
+				skipLog(path, "in failures list as "+it.from)
+				return
+			}
+		} else if it.from != "" && opts.Verbose {
+			log.Printf("scan: %s has the same content as %s", path, it.from)
+		}
+		if it.hit {
+			// Entries cached before pre-pass outputs were told apart are
+			// reclassified from their probe record's marker.
+			if it.meta.Probe != nil {
+				it.codec = classify(it.codec, *it.meta.Probe)
+			}
+			writer.write(path, it.codec, it.meta, it.mod, sz)
+			if sz < paths.MinSize {
+				skipLog(path, "cached: too small (<10MB)")
+				return
+			}
+			if it.mod.After(cutoff) {
+				skipLog(path, "cached: modified in last 3 days")
+				return
+			}
+			if it.codec == "X" {
+				skipLog(path, "cached: probe failed previously")
+				return
+			}
+			if it.codec == "av1" || it.codec == "flicksqueeze" {
+				skipLog(path, "cached: already "+it.codec)
+				return
+			}
+			if outputExists(fsys, path) {
+				skipLog(path, "cached: output exists")
+				return
+			}
+			enqueue(path, it.codec, sz, it.meta)
+			return
+		}
+
+		if it.err != nil {
+			log.Printf("scan: skipping %s (probe failed: %v)", path, it.err)
+			writer.write(path, "X", it.meta, it.mod, sz)
+			return
+		}
+		writer.write(path, it.codec, it.meta, it.mod, sz)
+		if it.codec == "av1" || it.codec == "flicksqueeze" {
+			return
+		}
+		if outputExists(fsys, path) {
+			skipLog(path, "output exists")
+			return
+		}
+		enqueue(path, it.codec, sz, it.meta)
+	}
+
+	// drain settles finished files from the front of pending; with wait it
+	// waits for all of them. Results of an interrupted scan are dropped, as
+	// their probes may have failed only because of the interruption.
+	drain := func(wait bool) {
+		for len(pending) > 0 {
+			it := pending[0]
+			if wait {
+				<-it.done
+			} else {
+				select {
+				case <-it.done:
+				default:
+					return
+				}
+			}
+			pending = pending[1:]
+			if ctx.Err() == nil {
+				settle(it)
+			}
 		}
 	}
 
@@ -134,6 +369,13 @@ func Scan(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, rootPath str
 				skipLog(path, "skip dir: "+d.Name())
 				return fs.SkipDir
 			}
+			if paths.IsWorkDir(d.Name()) || d.Name() == paths.StateDir {
+				return fs.SkipDir
+			}
+			if opts.Archive != "" && filepath.Clean(path) == filepath.Clean(opts.Archive) {
+				skipLog(path, "hevc_archive")
+				return fs.SkipDir
+			}
 			return nil
 		}
 
@@ -149,6 +391,10 @@ func Scan(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, rootPath str
 			skipLog(path, "in failures list")
 			return nil
 		}
+		if reviews[paths.Rel(rootPath, path)] {
+			skipLog(path, "awaiting review")
+			return nil
+		}
 		if isLocked(fsys, path) {
 			skipLog(path, "locked")
 			return nil
@@ -161,69 +407,48 @@ func Scan(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, rootPath str
 		mod := info.ModTime()
 		sz := info.Size()
 
-		cachedCodec, hit := reader.advanceTo(path, mod, sz)
+		it := &scanItem{path: path, mod: mod, size: sz, done: make(chan struct{})}
+		it.codec, it.meta, it.hit = reader.advanceTo(path, mod, sz)
+		if jm, ok := lookupJournal(journal, path, mod, sz); ok {
+			jm.merge(it.meta)
+			it.meta = jm
+		}
 
-		if hit {
-			writer.write(path, cachedCodec, mod, sz)
+		if !it.hit {
 			if sz < paths.MinSize {
-				skipLog(path, "cached: too small (<10MB)")
+				skipLog(path, "too small (<10MB)")
 				return nil
 			}
 			if mod.After(cutoff) {
-				skipLog(path, "cached: modified in last 3 days")
-				return nil
-			}
-			if cachedCodec == "X" {
-				skipLog(path, "cached: probe failed previously")
-				return nil
-			}
-			if cachedCodec == "av1" || cachedCodec == "flicksqueeze" {
-				skipLog(path, "cached: already "+cachedCodec)
+				skipLog(path, "modified in last 3 days")
 				return nil
 			}
-			if outputExists(fsys, path) {
-				skipLog(path, "cached: output exists")
-				return nil
-			}
-			enqueue(path, cachedCodec, sz)
-			return nil
-		}
-
-		if sz < paths.MinSize {
-			skipLog(path, "too small (<10MB)")
-			return nil
-		}
-		if mod.After(cutoff) {
-			skipLog(path, "modified in last 3 days")
-			return nil
 		}
 
-		probed, err := enc.VideoCodec(ctx, path)
-		if err != nil {
-			log.Printf("scan: skipping %s (probe failed: %v)", path, err)
-			writer.write(path, "X", mod, sz)
-			return nil
-		}
-		codec := strings.ToLower(probed)
-
-		if codec == "av1" {
-			comment, _ := enc.Comment(ctx, path)
-			if comment == paths.MetaComment {
-				codec = "flicksqueeze"
+		// Entries cached before the probe record or fingerprint was indexed
+		// are probed once more; the cached codec is kept.
+		pending = append(pending, it)
+		stale := it.meta.FP == "" || (it.meta.Probe == nil && it.codec != "X")
+		if !it.hit || (stale && sz >= paths.MinSize && !mod.After(cutoff)) {
+			batch = append(batch, it)
+			if len(batch) >= opts.ProbeBatch {
+				if err := dispatch(); err != nil {
+					return err
+				}
 			}
-			writer.write(path, codec, mod, sz)
-			return nil
+		} else {
+			close(it.done)
 		}
-		writer.write(path, codec, mod, sz)
-		if outputExists(fsys, path) {
-			skipLog(path, "output exists")
-			return nil
-		}
-		enqueue(path, codec, sz)
+		drain(false)
 		return nil
 	})
 
-	flushAll(ctx, &buf, out)
+	_ = dispatch()
+	drain(true)
+	if opts.Queue != nil && ctx.Err() == nil {
+		opts.Queue.replace(ready.snapshot())
+	}
+	ready.finish()
 
 	if err := writer.close(); err != nil {
 		log.Printf("scan: index write error: %v", err)
@@ -231,44 +456,140 @@ func Scan(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, rootPath str
 	}
 	if writerOK && ctx.Err() == nil {
 		finishIndex(fsys, tmpPath, writer.n)
+		compactJournal(fsys, rootPath, journalLen)
 	} else if ctx.Err() != nil {
 		log.Println("scan interrupted, keeping previous index")
 	}
+	indexed()
 
 	log.Printf("scan complete: %d conversion candidates evaluated", scanned)
 }
 
-// tryFlushBest does a non-blocking send of the highest-waste candidate.
-// If the consumer is busy encoding, the send is skipped and the candidate
-// stays in the buffer for the end-of-scan flush.
-func tryFlushBest(_ context.Context, buf *[]Candidate, out chan<- Candidate) {
-	if len(*buf) == 0 {
+// scanItem is a file the walk reached. Its codec and meta are final once
+// done is closed.
+type scanItem struct {
+	path  string
+	mod   time.Time
+	size  int64
+	hit   bool // codec and meta came from the index
+	codec string
+	meta  FileMeta
+	err   error // probe failure of an uncached file
+	done  chan struct{}
+
+	from  string // path the content was indexed under before
+	moved bool   // from is gone, rather than a copy of this file
+}
+
+// identify fingerprints items that lack one, recognising content indexed
+// under another path, then probes those still unknown in one batch.
+func identify(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, known *knownFiles, items []*scanItem) {
+	var probe []*scanItem
+	var files []string
+	for _, it := range items {
+		if it.meta.FP == "" {
+			it.meta.FP = Fingerprint(fsys, it.path, it.size)
+			if !it.hit && it.meta.FP != "" {
+				it.recognise(fsys, known)
+			}
+		}
+		if it.hit && (it.meta.Probe != nil || it.codec == "X") {
+			close(it.done)
+			continue
+		}
+		probe = append(probe, it)
+		files = append(files, it.path)
+	}
+	if len(probe) == 0 {
 		return
 	}
-	sort.Slice(*buf, func(i, j int) bool {
-		return (*buf)[i].WasteScore > (*buf)[j].WasteScore
-	})
-	select {
-	case out <- (*buf)[0]:
-		*buf = (*buf)[1:]
-	default:
+	recs, errs := enc.ProbeBatch(ctx, files)
+	for i, it := range probe {
+		it.probed(recs[i], errs[i])
 	}
 }
 
-// flushAll sends every remaining candidate in waste-score order, blocking
-// until the consumer is ready for each one.
-func flushAll(ctx context.Context, buf *[]Candidate, out chan<- Candidate) {
-	sort.Slice(*buf, func(i, j int) bool {
-		return (*buf)[i].WasteScore > (*buf)[j].WasteScore
-	})
-	for len(*buf) > 0 {
-		select {
-		case out <- (*buf)[0]:
-			*buf = (*buf)[1:]
-		case <-ctx.Done():
-			return
+// probed classifies it from its probe, recognising our own outputs by their
+// marker. Cached items only gain the probe record.
+func (it *scanItem) probed(rec ffmpeglib.ProbeRecord, err error) {
+	defer close(it.done)
+	if it.hit {
+		if err == nil {
+			it.meta.Probe = &rec
+			if vi, err := rec.Video(); err == nil {
+				it.meta.Video = videoMeta(vi)
+			}
 		}
+		return
+	}
+	var vi ffmpeglib.VideoInfo
+	if err == nil {
+		vi, err = rec.Video()
+	}
+	if err != nil {
+		it.err = err
+		return
+	}
+	it.meta.Video = videoMeta(vi)
+	it.meta.Probe = &rec
+	it.codec = classify(strings.ToLower(vi.Codec), rec)
+}
+
+// classify tells our own files apart by their marker: finished AV1 outputs,
+// and HEVC pre-pass outputs awaiting their AV1 stage.
+func classify(codec string, rec ffmpeglib.ProbeRecord) string {
+	switch {
+	case codec == "av1" && rec.Comment() == paths.MetaComment:
+		return "flicksqueeze"
+	case codec == "hevc" && rec.Comment() == paths.HEVCMetaComment:
+		return paths.StageHEVCPending
+	}
+	return codec
+}
+
+func videoMeta(vi ffmpeglib.VideoInfo) *VideoMeta {
+	return &VideoMeta{
+		Width:    vi.Width,
+		Height:   vi.Height,
+		FPS:      vi.FPS,
+		Duration: vi.Duration,
+		Bitrate:  vi.Bitrate,
+	}
+}
+
+// pendingCandidate ranks HEVC pre-pass output by its pipeline stage. When the
+// original is still retained, the AV1 stage reclaims all of the HEVC file plus
+// the expected savings on the original; otherwise it is scored as plain hevc.
+func pendingCandidate(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, path string, sz int64, meta FileMeta, mode string, tally map[string]float64) Candidate {
+	c := Candidate{
+		Path:       path,
+		Size:       sz,
+		Codec:      "hevc",
+		Stage:      paths.StageHEVCPending,
+		WasteScore: float64(sz) * savingsRatio("hevc", mode, tally),
+		Why:        "hevc pre-pass output, original no longer retained",
+	}
+	var tags map[string]string
+	if meta.Probe != nil {
+		tags = meta.Probe.Tags // read by the scan's probe
+	} else if t, err := enc.FormatTags(ctx, path, paths.OriginalTag, paths.OriginalCodecTag); err == nil {
+		tags = t
+	}
+	if tags[paths.OriginalTag] == "" {
+		return c
+	}
+	src := paths.ResolveLink(path, tags[paths.OriginalTag])
+	info, err := fsys.Stat(src)
+	if err != nil {
+		return c
 	}
+	c.Source = src
+	c.SourceSize = info.Size()
+	c.SourceCodec = strings.ToLower(tags[paths.OriginalCodecTag])
+	r := savingsRatio(c.SourceCodec, mode, tally)
+	c.WasteScore = float64(sz) + float64(c.SourceSize)*r
+	c.Why = fmt.Sprintf("hevc pre-pass output: AV1 stage frees it plus ~%.0f%% of the retained %s original", r*100, c.SourceCodec)
+	return c
 }
 
 const lockFreshness = 10 * time.Minute
@@ -0,0 +1,94 @@
+package scanner
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// bppTarget is the bits per pixel per frame at which a codec counts as
+// efficiently encoded. Files at or below it are left alone; the bitrate above
+// it is the waste a conversion is expected to reclaim.
+var bppTarget = map[string]float64{
+	"mpeg1video": 0.20,
+	"mpeg2video": 0.20,
+	"msmpeg4v1":  0.15,
+	"msmpeg4v2":  0.15,
+	"msmpeg4v3":  0.15,
+	"wmv1":       0.15,
+	"wmv2":       0.15,
+	"wmv3":       0.15,
+	"mpeg4":      0.12,
+	"vp8":        0.10,
+	"h264":       0.08,
+	"hevc":       0.05,
+	"vp9":        0.045,
+	"av1":        0.035,
+}
+
+const defaultBPPTarget = 0.10 // unknown codec
+
+// TargetBPP is the efficient bits per pixel per frame for codec; comparing
+// a file's BPP with it tells how generously the file is encoded.
+func TargetBPP(codec string) float64 {
+	codec = strings.ToLower(codec)
+	if codec == "flicksqueeze" {
+		codec = "av1"
+	}
+	if t, ok := bppTarget[codec]; ok {
+		return t
+	}
+	return defaultBPPTarget
+}
+
+// BPP returns bits per pixel per frame, or 0 when any input is unknown.
+func (v VideoMeta) BPP() float64 {
+	pixelsPerSec := float64(v.Width) * float64(v.Height) * v.FPS
+	if pixelsPerSec <= 0 || v.Bitrate <= 0 {
+		return 0
+	}
+	return float64(v.Bitrate) / pixelsPerSec
+}
+
+// score estimates the bytes a conversion would reclaim and explains how. ok
+// is false when the file is already at or below its codec's efficient target.
+//
+// A preflight prediction is the best evidence and wins. Otherwise the video
+// bytes are scored by how far their bits per pixel exceed the codec's target,
+// scaled by how past encodes of the codec did against expectations, falling
+// back to the per-codec savings ratio when stream data is missing.
+func score(codec string, sz int64, meta FileMeta, mode string, tally map[string]float64) (waste float64, why string, ok bool) {
+	codec = strings.ToLower(codec)
+	if p := meta.Pred; p != nil {
+		return float64(sz) * p.Ratio, fmt.Sprintf("%s: preflight predicts %.0f%% savings", codec, p.Ratio*100), true
+	}
+
+	v := meta.Video
+	if v == nil || v.BPP() == 0 {
+		r := savingsRatio(codec, mode, tally)
+		return float64(sz) * r, fmt.Sprintf("%s: no stream data, expect %.0f%% savings", codec, r*100), true
+	}
+
+	target := TargetBPP(codec)
+	bpp := v.BPP()
+	desc := fmt.Sprintf("%s %dx%d@%.3g %.1f Mb/s: %.3f bpp vs %.3f target",
+		codec, v.Width, v.Height, v.FPS, float64(v.Bitrate)/1e6, bpp, target)
+	if bpp <= target {
+		return 0, desc, false
+	}
+
+	// Audio and subtitles are copied unchanged; only the video shrinks.
+	videoBytes := float64(sz)
+	if v.Duration > 0 {
+		videoBytes = math.Min(float64(v.Bitrate)/8*v.Duration, videoBytes)
+	}
+	excess := 1 - target/bpp
+	why = fmt.Sprintf("%s, %.0f%% excess of %s video", desc, excess*100, HumanSize(int64(videoBytes)))
+	if r, ok := tallyRatio(codec, mode, tally); ok {
+		prior := priorRatio(codec)
+		f := r / prior
+		excess = math.Min(excess*f, 1)
+		why += fmt.Sprintf(", x%.2f from the tally (%.0f%% saved vs %.0f%% expected)", f, r*100, prior*100)
+	}
+	return videoBytes * excess, why, true
+}
@@ -2,25 +2,66 @@ package scanner
 
 import (
 	"bufio"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/snadrus/flicksqueeze/internal/config"
 	"github.com/snadrus/flicksqueeze/internal/paths"
 	"github.com/snadrus/flicksqueeze/internal/vfs"
 )
 
+// TallyFailed is the type of tally rows recording an encode that produced
+// nothing usable: it failed, was aborted as not smaller, or was rejected by
+// validation.
+const TallyFailed = "failed"
+
+// Weight of a failed attempt in the savings model, per hour of encoding it
+// wasted, and bounds on it. A success weighs 1.
+const (
+	failedWeightPerHour = 0.5
+	failedWeightMin     = 0.5
+	failedWeightMax     = 4.0
+)
+
+// failedWeight is how much a failed attempt that ran for hours (column 12;
+// unknown in old rows) counts against its codec's savings.
+func failedWeight(parts []string) float64 {
+	hours := 0.0
+	if len(parts) >= 12 {
+		hours, _ = strconv.ParseFloat(parts[11], 64)
+	}
+	return math.Min(math.Max(hours*failedWeightPerHour, failedWeightMin), failedWeightMax)
+}
+
+// TallyModeUnknown is the mode of tally rows encoded with a mode that is not
+// known; they count toward their codec's savings over all modes only.
+const TallyModeUnknown = "-"
+
+// TallyKey identifies a savings bucket: lowercase source codec and the
+// rate-control mode it was encoded with (e.g. "h264/crf").
+func TallyKey(codec, mode string) string {
+	return strings.ToLower(codec) + "/" + mode
+}
+
 // LoadTally reads .flicksqueeze.log from the given paths and returns empirical savings
-// ratios by codec. Key is lowercase codec (e.g. "h264"). Value is mean savings ratio
-// in [0,1], i.e. (origSize - outSize) / origSize. Merges data from all readable paths.
+// ratios keyed by TallyKey, plus one per codec over all modes, keyed by the
+// codec alone. Value is mean savings ratio in [0,1], i.e.
+// (origSize - outSize) / origSize. Outputs that did not shrink count as zero
+// savings, and so do failed attempts, weighted by the encode time they
+// wasted, so codecs that rarely pay off sink in the ranking. Rows written
+// before the mode column existed count as CRF (AV1) or hardware (HEVC).
+// Merges data from all readable paths.
 // Returns nil if no file could be read or all were empty.
 func LoadTally(fsys vfs.FS, tallyPaths ...string) map[string]float64 {
 	type sum struct {
 		totalRatio float64
-		n          int
+		weight     float64
 	}
-	byCodec := make(map[string]*sum)
+	byKey := make(map[string]*sum)
 
 	parseFile := func(rc *bufio.Scanner) {
 		for rc.Scan() {
@@ -29,17 +70,36 @@ func LoadTally(fsys vfs.FS, tallyPaths ...string) map[string]float64 {
 				continue
 			}
 			codec := strings.ToLower(strings.TrimSpace(parts[2]))
+			mode := config.ModeCRF
+			if parts[1] == "hevc" {
+				mode = config.ModeHW
+			}
+			if len(parts) >= 8 && parts[7] != "" {
+				mode = parts[7]
+			}
+			keys := []string{TallyKey(codec, mode), codec}
+			if mode == TallyModeUnknown {
+				keys = keys[1:]
+			}
 			origSize, err1 := strconv.ParseInt(parts[3], 10, 64)
 			outSize, err2 := strconv.ParseInt(parts[4], 10, 64)
-			if err1 != nil || err2 != nil || origSize <= 0 || outSize < 0 || outSize >= origSize {
+			if err1 != nil || err2 != nil || origSize <= 0 || outSize < 0 {
 				continue
 			}
-			ratio := float64(origSize-outSize) / float64(origSize)
-			if byCodec[codec] == nil {
-				byCodec[codec] = &sum{}
+			ratio, weight := 0.0, 1.0
+			switch {
+			case parts[1] == TallyFailed:
+				weight = failedWeight(parts)
+			case outSize < origSize:
+				ratio = float64(origSize-outSize) / float64(origSize)
+			}
+			for _, key := range keys {
+				if byKey[key] == nil {
+					byKey[key] = &sum{}
+				}
+				byKey[key].totalRatio += ratio * weight
+				byKey[key].weight += weight
 			}
-			byCodec[codec].totalRatio += ratio
-			byCodec[codec].n++
 		}
 	}
 
@@ -66,12 +126,95 @@ func LoadTally(fsys vfs.FS, tallyPaths ...string) map[string]float64 {
 		}
 	}
 
-	if len(byCodec) == 0 {
+	if len(byKey) == 0 {
 		return nil
 	}
-	out := make(map[string]float64, len(byCodec))
-	for codec, s := range byCodec {
-		out[codec] = s.totalRatio / float64(s.n)
+	out := make(map[string]float64, len(byKey))
+	for key, s := range byKey {
+		out[key] = s.totalRatio / s.weight
 	}
 	return out
 }
+
+// PredictionAccuracy compares the preflight predictions recorded in the
+// tally with the savings actually achieved. It returns the mean absolute
+// error (as a savings fraction) over the n rows that carry a prediction.
+func PredictionAccuracy(fsys vfs.FS, tallyPaths ...string) (meanAbsErr float64, n int) {
+	var total float64
+	for _, p := range tallyPaths {
+		rc, err := fsys.Open(p)
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(rc)
+		for sc.Scan() {
+			parts := strings.Split(sc.Text(), "\t")
+			if len(parts) < 9 || parts[8] == "" || parts[1] == TallyFailed {
+				continue
+			}
+			pred, err1 := strconv.ParseFloat(parts[8], 64)
+			origSize, err2 := strconv.ParseInt(parts[3], 10, 64)
+			outSize, err3 := strconv.ParseInt(parts[4], 10, 64)
+			if err1 != nil || err2 != nil || err3 != nil || origSize <= 0 {
+				continue
+			}
+			actual := float64(origSize-outSize) / float64(origSize)
+			total += math.Abs(pred - actual)
+			n++
+		}
+		rc.Close()
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	return total / float64(n), n
+}
+
+// TallyRow is one completed conversion from the tally.
+type TallyRow struct {
+	Time      time.Time
+	Type      string // "av1" or "hevc"
+	FromCodec string
+	OrigSize  int64
+	OutSize   int64
+	OrigPath  string
+	OutPath   string
+	SHA256    string // output checksum; empty in rows written before it was recorded
+}
+
+// LoadTallyRows returns the conversions recorded in the tally at tallyPath,
+// oldest first.
+func LoadTallyRows(fsys vfs.FS, tallyPath string) []TallyRow {
+	rc, err := fsys.Open(tallyPath)
+	if err != nil {
+		return nil
+	}
+	defer rc.Close()
+	var rows []TallyRow
+	sc := bufio.NewScanner(rc)
+	for sc.Scan() {
+		parts := strings.Split(sc.Text(), "\t")
+		if len(parts) < 7 {
+			continue
+		}
+		origSize, err1 := strconv.ParseInt(parts[3], 10, 64)
+		outSize, err2 := strconv.ParseInt(parts[4], 10, 64)
+		if err1 != nil || err2 != nil || parts[1] == TallyFailed {
+			continue
+		}
+		row := TallyRow{
+			Type:      parts[1],
+			FromCodec: parts[2],
+			OrigSize:  origSize,
+			OutSize:   outSize,
+			OrigPath:  parts[5],
+			OutPath:   parts[6],
+		}
+		row.Time, _ = time.Parse(time.RFC3339, parts[0])
+		if len(parts) >= 11 {
+			row.SHA256 = parts[10]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
@@ -0,0 +1,150 @@
+package scanner
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/snadrus/flicksqueeze/internal/vfs"
+)
+
+func TestFailedWeight(t *testing.T) {
+	tests := []struct {
+		name  string
+		hours string // column 12; "" leaves the row short
+		want  float64
+	}{
+		{"old row without hours", "", failedWeightMin},
+		{"unreadable hours", "x", failedWeightMin},
+		{"no time wasted", "0", failedWeightMin},
+		{"below the floor", "0.5", failedWeightMin},
+		{"in range", "3", 1.5},
+		{"at the cap", "8", failedWeightMax},
+		{"above the cap", "100", failedWeightMax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := strings.Split("t\tfailed\th264\t1000\t0\t/a\t/b\tcrf\t\t\t", "\t")
+			if tt.hours != "" {
+				parts = append(parts, tt.hours)
+			}
+			if got := failedWeight(parts); got != tt.want {
+				t.Errorf("failedWeight = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTally(t *testing.T) {
+	const ts = "2026-01-02T03:04:05Z"
+	tests := []struct {
+		name string
+		rows []string
+		want map[string]float64 // keys that must be present, with their ratios
+		none []string           // keys that must be absent
+	}{
+		{
+			name: "av1 row before the mode column counts as crf",
+			rows: []string{ts + "\tav1\tH264\t1000\t600\t/a\t/b"},
+			want: map[string]float64{"h264/crf": 0.4, "h264": 0.4},
+		},
+		{
+			name: "hevc row before the mode column counts as hardware",
+			rows: []string{ts + "\thevc\tmpeg4\t1000\t500\t/a\t/b"},
+			want: map[string]float64{"mpeg4/hw": 0.5},
+			none: []string{"mpeg4/crf"},
+		},
+		{
+			name: "mode column",
+			rows: []string{ts + "\tav1\th264\t1000\t700\t/a\t/b\tvbr"},
+			want: map[string]float64{"h264/vbr": 0.3},
+			none: []string{"h264/crf"},
+		},
+		{
+			name: "prediction, quality, sha256 and hours columns",
+			rows: []string{ts + "\tav1\th264\t1000\t800\t/a\t/b\thybrid\t0.2500\tvmaf:95.000/90.000/92.000\tabc123\t1.500"},
+			want: map[string]float64{"h264/hybrid": 0.2, "h264": 0.2},
+		},
+		{
+			name: "empty mode column counts as crf",
+			rows: []string{ts + "\tav1\th264\t1000\t600\t/a\t/b\t\t\t\t\t0.100"},
+			want: map[string]float64{"h264/crf": 0.4},
+		},
+		{
+			name: "unknown mode counts toward the codec only",
+			rows: []string{ts + "\tav1\th264\t1000\t600\t/a\t/b\t" + TallyModeUnknown},
+			want: map[string]float64{"h264": 0.4},
+			none: []string{"h264/" + TallyModeUnknown},
+		},
+		{
+			name: "output that grew saves nothing",
+			rows: []string{ts + "\tav1\tvp9\t1000\t1200\t/a\t/b\tcrf"},
+			want: map[string]float64{"vp9/crf": 0},
+		},
+		{
+			name: "failed attempts weigh by the hours they wasted",
+			rows: []string{
+				ts + "\tav1\th264\t1000\t500\t/a\t/b\tcrf\t\t\t\t2.000",
+				ts + "\tfailed\th264\t1000\t0\t/c\t\tcrf\t\t\t\t4.000",
+			},
+			// 0.5 at weight 1, 0 at weight 2.
+			want: map[string]float64{"h264/crf": 0.5 / 3},
+		},
+		{
+			name: "unreadable rows are skipped",
+			rows: []string{
+				"garbage",
+				ts + "\tav1\th264\tx\t500\t/a\t/b",
+				ts + "\tav1\th264\t0\t0\t/a\t/b",
+				ts + "\tav1\th264\t1000\t900\t/a\t/b",
+			},
+			want: map[string]float64{"h264/crf": 0.1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir()) // no tally in the home folder
+			p := filepath.Join(t.TempDir(), "tally")
+			if err := os.WriteFile(p, []byte(strings.Join(tt.rows, "\n")+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got := LoadTally(vfs.Local{}, p)
+			for key, want := range tt.want {
+				r, ok := got[key]
+				if !ok || math.Abs(r-want) > 1e-9 {
+					t.Errorf("%s = %v (present %v), want %v", key, r, ok, want)
+				}
+			}
+			for _, key := range tt.none {
+				if _, ok := got[key]; ok {
+					t.Errorf("%s present, want absent", key)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadTallyRows(t *testing.T) {
+	const ts = "2026-01-02T03:04:05Z"
+	rows := strings.Join([]string{
+		ts + "\tav1\th264\t1000\t600\t/a\t/b",
+		ts + "\tav1\th264\t1000\t600\t/c\t/d\tcrf\t0.4000\t\tabc123\t1.000",
+		ts + "\tfailed\th264\t1000\t0\t/e\t\tcrf\t\t\t\t1.000",
+	}, "\n")
+	p := filepath.Join(t.TempDir(), "tally")
+	if err := os.WriteFile(p, []byte(rows), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got := LoadTallyRows(vfs.Local{}, p)
+	if len(got) != 2 {
+		t.Fatalf("got %d rows, want 2 (failed attempts left out)", len(got))
+	}
+	if got[0].SHA256 != "" || got[1].SHA256 != "abc123" {
+		t.Errorf("sha256 columns %q, %q; want \"\", \"abc123\"", got[0].SHA256, got[1].SHA256)
+	}
+	if got[1].OrigPath != "/c" || got[1].OutPath != "/d" || got[1].OutSize != 600 {
+		t.Errorf("row %+v", got[1])
+	}
+}
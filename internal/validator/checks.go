@@ -0,0 +1,186 @@
+package validator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/snadrus/flicksqueeze/internal/paths"
+)
+
+// Built-in checks, in the order they run by default: cheap metadata checks
+// first, full reads of the output last.
+
+const (
+	qualitySamples   = 6
+	qualitySampleSec = 10.0
+
+	// Segmented encodes may gain or lose a frame at each segment boundary.
+	maxFrameDrift = 0.001 // fraction of the source's frames
+	minFrameDrift = 5
+)
+
+// sizeCheck: the output must be smaller than the input.
+type sizeCheck struct{}
+
+func (sizeCheck) Name() string { return "size" }
+
+func (sizeCheck) Run(_ context.Context, s *Subject, _ *Result) (string, error) {
+	if s.OutputSize >= s.InputSize {
+		return "", fmt.Errorf("output %s (%s) is not smaller than input %s (%s)",
+			s.OutputPath, formatSizeBytes(s.OutputSize),
+			s.InputPath, formatSizeBytes(s.InputSize))
+	}
+	return fmt.Sprintf("%.0f%% of input", float64(s.OutputSize)/float64(s.InputSize)*100), nil
+}
+
+// minSizeCheck: a tiny output is almost certainly truncated.
+type minSizeCheck struct{}
+
+func (minSizeCheck) Name() string { return "min-size" }
+
+func (minSizeCheck) Run(_ context.Context, s *Subject, _ *Result) (string, error) {
+	if s.OutputSize < paths.MinSize {
+		return "", fmt.Errorf("output %s too small (%s), likely corrupt", s.OutputPath, formatSizeBytes(s.OutputSize))
+	}
+	return formatSizeBytes(s.OutputSize), nil
+}
+
+// durationCheck: container durations must match within maxDrift seconds.
+type durationCheck struct{ maxDrift float64 }
+
+func (durationCheck) Name() string { return "duration" }
+
+func (c durationCheck) Run(ctx context.Context, s *Subject, _ *Result) (string, error) {
+	inDur, outDur, err := s.durations(ctx)
+	if err != nil {
+		return "", err
+	}
+	if math.Abs(inDur-outDur) > c.maxDrift {
+		return "", fmt.Errorf("duration mismatch: input %.1fs vs output %.1fs", inDur, outDur)
+	}
+	return fmt.Sprintf("%.1fs vs %.1fs", inDur, outDur), nil
+}
+
+// streamCheck: tracks, languages, audio layouts, durations and A/V offset
+// must match, less what the encode intentionally dropped.
+type streamCheck struct{}
+
+func (streamCheck) Name() string { return "streams" }
+
+func (streamCheck) Run(ctx context.Context, s *Subject, _ *Result) (string, error) {
+	probed, errs := s.Enc.ProbeStreamsBatch(ctx, []string{s.InputPath, s.OutputPath})
+	if errs[0] != nil {
+		return "", fmt.Errorf("cannot probe input streams: %w", errs[0])
+	}
+	if errs[1] != nil {
+		return "", fmt.Errorf("cannot probe output streams: %w", errs[1])
+	}
+	inStreams, outStreams := probed[0], probed[1]
+	if problems := checkStreams(inStreams, outStreams, s.Dropped); len(problems) > 0 {
+		return "", fmt.Errorf("stream mismatch: %s", strings.Join(problems, "; "))
+	}
+	t := tracks(outStreams)
+	return fmt.Sprintf("%d video, %d audio, %d subtitle", len(t["video"]), len(t["audio"]), len(t["subtitle"])), nil
+}
+
+// qualityCheck: sampled perceptual scores must clear the floors, given per
+// metric as {worst frame, 5th percentile}.
+type qualityCheck struct{ floors map[string][2]float64 }
+
+func (qualityCheck) Name() string { return "quality" }
+
+func (c qualityCheck) Run(ctx context.Context, s *Subject, r *Result) (string, error) {
+	_, outDur, err := s.durations(ctx)
+	if err != nil {
+		return "", err
+	}
+	scores, err := s.Enc.MeasureQuality(ctx, s.InputPath, s.OutputPath, sampleStarts(outDur), qualitySampleSec)
+	if err != nil {
+		return "", err
+	}
+	r.Quality = scores
+	var measured []string
+	for _, q := range scores {
+		f := c.floors[q.Metric]
+		if q.Min < f[0] || q.P5 < f[1] {
+			return "", fmt.Errorf("quality too low: %s (floors min=%.3g p5=%.3g)", q, f[0], f[1])
+		}
+		measured = append(measured, q.String())
+	}
+	return strings.Join(measured, "; "), nil
+}
+
+// sampleStarts spreads the quality samples evenly over the file.
+func sampleStarts(duration float64) []float64 {
+	starts := make([]float64, qualitySamples)
+	for i := range starts {
+		starts[i] = math.Max(duration*float64(i+1)/float64(qualitySamples+1)-qualitySampleSec/2, 0)
+	}
+	return starts
+}
+
+// decodeCheck: the whole output must decode cleanly to as many frames as
+// the source has.
+type decodeCheck struct{ maxErrors int }
+
+func (decodeCheck) Name() string { return "decode" }
+
+func (c decodeCheck) Run(ctx context.Context, s *Subject, r *Result) (string, error) {
+	srcFrames, err := s.Enc.VideoFrameCount(ctx, s.InputPath)
+	if err != nil {
+		return "", fmt.Errorf("cannot count input frames: %w", err)
+	}
+	dec, err := s.Enc.DecodeCheck(ctx, s.OutputPath)
+	if err != nil {
+		return "", err
+	}
+	r.Decode = &dec
+	if dec.Errors > c.maxErrors {
+		return "", fmt.Errorf("%d decode errors (max %d), first: %s",
+			dec.Errors, c.maxErrors, strings.Join(dec.First, "; "))
+	}
+	if !framesMatch(dec.Frames, srcFrames) {
+		// Packets are not always frames; decode the input to be sure.
+		srcFrames, err = s.Enc.DecodedFrameCount(ctx, s.InputPath)
+		if err != nil {
+			return "", fmt.Errorf("cannot count input frames: %w", err)
+		}
+		if !framesMatch(dec.Frames, srcFrames) {
+			return "", fmt.Errorf("decoded %d frames, input has %d", dec.Frames, srcFrames)
+		}
+	}
+	return fmt.Sprintf("%d frames, %d errors", dec.Frames, dec.Errors), nil
+}
+
+// framesMatch reports whether got frames are as many as want, give or take
+// the drift of segmented encodes.
+func framesMatch(got, want int64) bool {
+	drift := int64(math.Max(float64(want)*maxFrameDrift, minFrameDrift))
+	diff := got - want
+	return diff <= drift && -diff <= drift
+}
+
+// commandCheck runs an external program, where the files live, with the
+// input and output paths as its last two arguments. Exit status 0 passes.
+type commandCheck struct{ argv []string }
+
+func (commandCheck) Name() string { return "command" }
+
+func (c commandCheck) Run(ctx context.Context, s *Subject, _ *Result) (string, error) {
+	args := append(append([]string(nil), c.argv[1:]...), s.InputPath, s.OutputPath)
+	stdout, stderr, err := s.FS.Exec(ctx, c.argv[0], args...)
+	if err != nil {
+		msg := strings.TrimSpace(string(stderr))
+		if msg == "" {
+			msg = strings.TrimSpace(string(stdout))
+		}
+		if msg == "" {
+			return "", fmt.Errorf("%s: %w", c.argv[0], err)
+		}
+		return "", errors.New(c.argv[0] + ": " + msg)
+	}
+	return strings.TrimSpace(string(stdout)), nil
+}
@@ -0,0 +1,96 @@
+package validator
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
+)
+
+const (
+	// maxSyncDrift is how far the audio/video start offset may move, in
+	// seconds. Around 45 ms of lip-sync error is noticeable.
+	maxSyncDrift = 0.045
+
+	maxStreamDrift = 5.0 // per-stream duration tolerance, seconds
+)
+
+// Dropped lists what an encode intentionally left out of its output.
+type Dropped struct {
+	Subtitles  bool // retried without subtitles after a mux failure
+	ExtraVideo bool // only the primary video track is kept
+}
+
+// tracks groups a file's streams by type, leaving out cover art,
+// attachments and data streams, which encodes never carry over.
+func tracks(streams []ffmpeglib.StreamInfo) map[string][]ffmpeglib.StreamInfo {
+	byType := make(map[string][]ffmpeglib.StreamInfo)
+	for _, s := range streams {
+		switch {
+		case s.Type == "video" && !s.CoverArt, s.Type == "audio", s.Type == "subtitle":
+			byType[s.Type] = append(byType[s.Type], s)
+		}
+	}
+	return byType
+}
+
+// checkStreams compares the stream inventory of input and output and
+// returns every mismatch found.
+func checkStreams(in, out []ffmpeglib.StreamInfo, dropped Dropped) []string {
+	inT, outT := tracks(in), tracks(out)
+	var problems []string
+	mismatch := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	wantVideo := len(inT["video"])
+	if dropped.ExtraVideo && wantVideo > 1 {
+		wantVideo = 1
+	}
+	wantSubs := len(inT["subtitle"])
+	if dropped.Subtitles && len(outT["subtitle"]) == 0 {
+		wantSubs = 0
+	}
+	for _, c := range []struct {
+		kind string
+		want int
+	}{{"video", wantVideo}, {"audio", len(inT["audio"])}, {"subtitle", wantSubs}} {
+		if got := len(outT[c.kind]); got != c.want {
+			mismatch("%s streams: output has %d, expected %d", c.kind, got, c.want)
+		}
+	}
+
+	for kind, outs := range outT {
+		ins := inT[kind]
+		for i := 0; i < len(outs) && i < len(ins); i++ {
+			a, b := ins[i], outs[i]
+			name := fmt.Sprintf("%s #%d", kind, i+1)
+			if !strings.EqualFold(a.Language, b.Language) {
+				mismatch("%s language: %q became %q", name, a.Language, b.Language)
+			}
+			if kind == "audio" {
+				if a.Channels != b.Channels || a.ChannelLayout != b.ChannelLayout {
+					mismatch("%s channels: %d (%s) became %d (%s)", name,
+						a.Channels, a.ChannelLayout, b.Channels, b.ChannelLayout)
+				}
+				if a.SampleRate != b.SampleRate {
+					mismatch("%s sample rate: %d became %d", name, a.SampleRate, b.SampleRate)
+				}
+			}
+			// Subtitle durations end at the last cue and vary by muxer.
+			if kind != "subtitle" && a.Duration > 0 && b.Duration > 0 && math.Abs(a.Duration-b.Duration) > maxStreamDrift {
+				mismatch("%s duration: %.1fs became %.1fs", name, a.Duration, b.Duration)
+			}
+		}
+	}
+
+	if len(inT["video"]) > 0 && len(inT["audio"]) > 0 && len(outT["video"]) > 0 && len(outT["audio"]) > 0 {
+		inOff := inT["audio"][0].StartTime - inT["video"][0].StartTime
+		outOff := outT["audio"][0].StartTime - outT["video"][0].StartTime
+		if math.Abs(inOff-outOff) > maxSyncDrift {
+			mismatch("audio/video offset: %+.3fs became %+.3fs", inOff, outOff)
+		}
+	}
+	return problems
+}
@@ -1,54 +1,239 @@
+// Package validator decides whether an encode may replace its original.
+// Validation is an ordered chain of named checks chosen per library; the
+// first failing check rejects the output, and every run yields a Result
+// listing each check's outcome.
 package validator
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"math"
+	"strings"
+	"time"
 
+	"github.com/snadrus/flicksqueeze/internal/config"
 	"github.com/snadrus/flicksqueeze/internal/ffmpeglib"
-	"github.com/snadrus/flicksqueeze/internal/paths"
 	"github.com/snadrus/flicksqueeze/internal/vfs"
 )
 
-const maxDurationDrift = 5.0
+// Check is one validation step. Run returns a short description of what it
+// measured, or an error saying why the output is rejected. Checks may record
+// measurements in r for the conversion record.
+type Check interface {
+	Name() string
+	Run(ctx context.Context, s *Subject, r *Result) (string, error)
+}
 
-func formatSizeBytes(n int64) string {
-	const gb = 1024 * 1024 * 1024
-	const mb = 1024 * 1024
-	if n >= gb {
-		return fmt.Sprintf("%.1f GiB (%d bytes)", float64(n)/gb, n)
+// Subject is the encode being validated.
+type Subject struct {
+	FS         vfs.FS
+	Enc        *ffmpeglib.Encoder
+	InputPath  string
+	OutputPath string
+	InputSize  int64
+	OutputSize int64   // filled in by Chain.Run
+	Dropped    Dropped // what the encode intentionally left out
+
+	inDur, outDur float64 // probed once, shared between checks
+}
+
+// durations probes and caches the input and output durations.
+func (s *Subject) durations(ctx context.Context) (in, out float64, err error) {
+	if s.inDur > 0 && s.outDur > 0 {
+		return s.inDur, s.outDur, nil
 	}
-	return fmt.Sprintf("%.0f MiB (%d bytes)", float64(n)/mb, n)
+	recs, errs := s.Enc.ProbeBatch(ctx, []string{s.InputPath, s.OutputPath})
+	for i, side := range []string{"input", "output"} {
+		if errs[i] == nil && recs[i].Duration <= 0 {
+			errs[i] = errors.New("duration unavailable")
+		}
+		if errs[i] != nil {
+			return 0, 0, fmt.Errorf("cannot probe %s duration: %w", side, errs[i])
+		}
+	}
+	s.inDur, s.outDur = recs[0].Duration, recs[1].Duration
+	return s.inDur, s.outDur, nil
+}
+
+// Outcome is how one check went.
+type Outcome struct {
+	Check   string
+	Passed  bool
+	Detail  string // what was measured, or why it failed
+	Elapsed time.Duration
+}
+
+// Result is the structured record of a validation run.
+type Result struct {
+	Checks []Outcome
+
+	// Measurements kept for the conversion record.
+	Quality []ffmpeglib.QualityScores
+	Decode  *ffmpeglib.DecodeReport
 }
 
-func Validate(ctx context.Context, fsys vfs.FS, enc *ffmpeglib.Encoder, inputPath, outputPath string, inputSize int64) error {
-	outInfo, err := fsys.Stat(outputPath)
+func (r Result) String() string {
+	parts := make([]string, len(r.Checks))
+	for i, o := range r.Checks {
+		verdict := "ok"
+		if !o.Passed {
+			verdict = "FAILED"
+		}
+		parts[i] = fmt.Sprintf("%s %s (%s)", o.Check, verdict, o.Detail)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Chain is an ordered list of checks.
+type Chain []Check
+
+// Run validates s with each check in turn, stopping at the first failure.
+func (c Chain) Run(ctx context.Context, s Subject) (Result, error) {
+	var res Result
+	outInfo, err := s.FS.Stat(s.OutputPath)
 	if err != nil {
-		return fmt.Errorf("cannot stat output: %w", err)
+		return res, fmt.Errorf("cannot stat output: %w", err)
 	}
-	outSize := outInfo.Size()
+	s.OutputSize = outInfo.Size()
 
-	if outSize >= inputSize {
-		return fmt.Errorf("output %s (%s) is not smaller than input %s (%s)",
-			outputPath, formatSizeBytes(outSize),
-			inputPath, formatSizeBytes(inputSize))
+	for _, check := range c {
+		start := time.Now()
+		detail, err := check.Run(ctx, &s, &res)
+		o := Outcome{Check: check.Name(), Passed: err == nil, Detail: detail, Elapsed: time.Since(start)}
+		if err != nil {
+			o.Detail = err.Error()
+		}
+		res.Checks = append(res.Checks, o)
+		if err != nil {
+			return res, fmt.Errorf("%s: %w", check.Name(), err)
+		}
 	}
-	if outSize < paths.MinSize {
-		return fmt.Errorf("output %s too small (%s), likely corrupt", outputPath, formatSizeBytes(outSize))
+	return res, nil
+}
+
+// requiredChecks run first whether or not the library names them: without
+// them a truncated or empty output could replace its original.
+var requiredChecks = []string{"size", "min-size"}
+
+// FromConfig builds the chain named by the library's checks setting, with
+// its thresholds. The required checks go first unless placed explicitly,
+// and a configured check_command runs last unless placed explicitly.
+func FromConfig(lib config.Library) (Chain, error) {
+	var names []string
+	for _, name := range requiredChecks {
+		if !contains(lib.Checks, name) {
+			names = append(names, name)
+		}
+	}
+	names = append(names, lib.Checks...)
+	if lib.CheckCommand != "" && !contains(names, "command") {
+		names = append(names, "command")
+	}
+	var chain Chain
+	for _, name := range names {
+		var c Check
+		switch name {
+		case "size":
+			c = sizeCheck{}
+		case "min-size":
+			c = minSizeCheck{}
+		case "duration":
+			c = durationCheck{maxDrift: lib.DurationDrift}
+		case "streams":
+			c = streamCheck{}
+		case "quality":
+			c = qualityCheck{floors: map[string][2]float64{
+				ffmpeglib.MetricVMAF: {lib.VMAFMin, lib.VMAFP5},
+				ffmpeglib.MetricSSIM: {lib.SSIMMin, lib.SSIMP5},
+				ffmpeglib.MetricPSNR: {lib.PSNRMin, lib.PSNRP5},
+			}}
+		case "decode":
+			c = decodeCheck{maxErrors: lib.DecodeMaxErrors}
+		case "command":
+			if lib.CheckCommand == "" {
+				return nil, fmt.Errorf("checks: %q needs check_command", name)
+			}
+			argv, err := splitWords(lib.CheckCommand)
+			if err != nil {
+				return nil, fmt.Errorf("check_command: %w", err)
+			}
+			c = commandCheck{argv: argv}
+		default:
+			return nil, fmt.Errorf("checks: unknown check %q", name)
+		}
+		chain = append(chain, c)
 	}
+	return chain, nil
+}
 
-	inDur, err := enc.DurationSeconds(ctx, inputPath)
-	if err != nil {
-		return fmt.Errorf("cannot probe input duration: %w", err)
+// splitWords splits a command line into arguments the way a POSIX shell
+// does for plain words: blanks separate them, single quotes keep everything
+// literally, double quotes keep blanks, and a backslash escapes the next
+// character outside single quotes.
+func splitWords(s string) ([]string, error) {
+	var words []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
 	}
-	outDur, err := enc.DurationSeconds(ctx, outputPath)
-	if err != nil {
-		return fmt.Errorf("cannot probe output duration: %w", err)
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inWord {
+		words = append(words, cur.String())
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty command")
 	}
+	return words, nil
+}
 
-	if math.Abs(inDur-outDur) > maxDurationDrift {
-		return fmt.Errorf("duration mismatch: input %.1fs vs output %.1fs", inDur, outDur)
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
 	}
+	return false
+}
 
-	return nil
+func formatSizeBytes(n int64) string {
+	const gb = 1024 * 1024 * 1024
+	const mb = 1024 * 1024
+	if n >= gb {
+		return fmt.Sprintf("%.1f GiB (%d bytes)", float64(n)/gb, n)
+	}
+	return fmt.Sprintf("%.0f MiB (%d bytes)", float64(n)/mb, n)
 }
@@ -0,0 +1,30 @@
+package vfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// transferAttempts is how many times a copy whose checksum does not match
+// is tried before giving up.
+const transferAttempts = 3
+
+// hashCopy copies src to dst and returns the hex SHA-256 of what was copied.
+func hashCopy(dst io.Writer, src io.Reader) (sum string, n int64, err error) {
+	h := sha256.New()
+	n, err = io.Copy(io.MultiWriter(dst, h), src)
+	return hex.EncodeToString(h.Sum(nil)), n, err
+}
+
+// hashFile returns the hex SHA-256 of a local file.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum, _, err := hashCopy(io.Discard, f)
+	return sum, err
+}
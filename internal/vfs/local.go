@@ -45,40 +45,40 @@ func (Local) MkdirAll(path string, perm os.FileMode) error {
 	return os.MkdirAll(path, perm)
 }
 
-func (Local) CopyToLocal(remotePath, localPath string) error {
+func (Local) CopyToLocal(remotePath, localPath string) (string, error) {
 	if remotePath == localPath {
-		return nil
+		return hashFile(localPath)
 	}
-	src, err := os.Open(remotePath)
-	if err != nil {
-		return err
-	}
-	defer src.Close()
-	dst, err := os.Create(localPath)
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
-	_, err = io.Copy(dst, src)
-	return err
+	return copyFile(remotePath, localPath)
 }
 
-func (Local) CopyFromLocal(localPath, remotePath string) error {
+func (Local) CopyFromLocal(localPath, remotePath string) (string, error) {
 	if localPath == remotePath {
-		return nil
+		return hashFile(localPath)
 	}
-	src, err := os.Open(localPath)
+	return copyFile(localPath, remotePath)
+}
+
+func (Local) Hash(path string) (string, error) {
+	return hashFile(path)
+}
+
+// copyFile copies src to dst, hashing the data on the way.
+func copyFile(src, dst string) (string, error) {
+	in, err := os.Open(src)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer src.Close()
-	dst, err := os.Create(remotePath)
+	defer in.Close()
+	out, err := os.Create(dst)
 	if err != nil {
-		return err
+		return "", err
+	}
+	sum, _, err := hashCopy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
 	}
-	defer dst.Close()
-	_, err = io.Copy(dst, src)
-	return err
+	return sum, err
 }
 
 func (Local) Exec(ctx context.Context, name string, args ...string) ([]byte, []byte, error) {
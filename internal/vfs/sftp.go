@@ -196,45 +196,105 @@ func (s *SFTP) MkdirAll(path string, perm os.FileMode) error {
 	return s.client.MkdirAll(path)
 }
 
-func (s *SFTP) CopyToLocal(remotePath, localPath string) error {
+// CopyToLocal downloads remotePath, retrying until the local copy's hash
+// matches the remote file's.
+func (s *SFTP) CopyToLocal(remotePath, localPath string) (string, error) {
 	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
-		return err
-	}
-	src, err := s.client.Open(remotePath)
-	if err != nil {
-		return fmt.Errorf("sftp open %s: %w", remotePath, err)
-	}
-	defer src.Close()
-	dst, err := os.Create(localPath)
-	if err != nil {
-		return err
-	}
-	defer dst.Close()
-	size, err := io.Copy(dst, src)
-	if err != nil {
-		return fmt.Errorf("download %s: %w", remotePath, err)
+		return "", err
 	}
-	log.Printf("downloaded %s (%s)", remotePath, humanBytes(size))
-	return nil
+	return s.verified("download", remotePath, func() (string, int64, error) {
+		src, err := s.client.Open(remotePath)
+		if err != nil {
+			return "", 0, fmt.Errorf("sftp open %s: %w", remotePath, err)
+		}
+		defer src.Close()
+		dst, err := os.Create(localPath)
+		if err != nil {
+			return "", 0, err
+		}
+		sum, size, err := hashCopy(dst, src)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", 0, fmt.Errorf("download %s: %w", remotePath, err)
+		}
+		return sum, size, nil
+	})
 }
 
-func (s *SFTP) CopyFromLocal(localPath, remotePath string) error {
-	src, err := os.Open(localPath)
-	if err != nil {
-		return err
+// CopyFromLocal uploads localPath, retrying until the remote file's hash
+// matches the data sent.
+func (s *SFTP) CopyFromLocal(localPath, remotePath string) (string, error) {
+	return s.verified("upload", remotePath, func() (string, int64, error) {
+		src, err := os.Open(localPath)
+		if err != nil {
+			return "", 0, err
+		}
+		defer src.Close()
+		dst, err := s.client.Create(remotePath)
+		if err != nil {
+			return "", 0, fmt.Errorf("sftp create %s: %w", remotePath, err)
+		}
+		sum, size, err := hashCopy(dst, src)
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return "", 0, fmt.Errorf("upload %s: %w", remotePath, err)
+		}
+		return sum, size, nil
+	})
+}
+
+// verified runs transfer until the hash of the data it moved matches the hash of
+// remotePath taken on the server, up to transferAttempts times.
+func (s *SFTP) verified(what, remotePath string, transfer func() (sum string, size int64, err error)) (string, error) {
+	var lastErr error
+	for attempt := 1; attempt <= transferAttempts; attempt++ {
+		sum, size, err := transfer()
+		if err == nil {
+			var remoteSum string
+			remoteSum, err = s.Hash(remotePath)
+			if err == nil && remoteSum != sum {
+				err = fmt.Errorf("%s %s: checksum mismatch (copied %s, remote %s)", what, remotePath, sum[:12], remoteSum[:12])
+			}
+		}
+		if err == nil {
+			log.Printf("%sed %s (%s, sha256 %s)", what, remotePath, humanBytes(size), sum[:12])
+			return sum, nil
+		}
+		lastErr = err
+		if attempt < transferAttempts {
+			log.Printf("%v; retrying (%d/%d)", err, attempt+1, transferAttempts)
+		}
 	}
-	defer src.Close()
-	dst, err := s.client.Create(remotePath)
-	if err != nil {
-		return fmt.Errorf("sftp create %s: %w", remotePath, err)
+	return "", lastErr
+}
+
+// Hash runs sha256sum (or shasum) on the server. Without either, the file is
+// read back over SFTP and hashed here, which still catches a short or
+// corrupted write.
+func (s *SFTP) Hash(path string) (string, error) {
+	for _, argv := range [][]string{{"sha256sum", "--"}, {"shasum", "-a", "256", "--"}} {
+		out, _, err := s.Exec(context.Background(), argv[0], append(argv[1:], path)...)
+		if err != nil {
+			continue
+		}
+		// A leading backslash marks an escaped file name.
+		if f := strings.Fields(string(out)); len(f) > 0 {
+			if sum := strings.TrimPrefix(f[0], `\`); len(sum) == 64 {
+				return sum, nil
+			}
+		}
 	}
-	defer dst.Close()
-	size, err := io.Copy(dst, src)
+	f, err := s.client.Open(path)
 	if err != nil {
-		return fmt.Errorf("upload %s: %w", remotePath, err)
+		return "", err
 	}
-	log.Printf("uploaded %s (%s)", remotePath, humanBytes(size))
-	return nil
+	defer f.Close()
+	sum, _, err := hashCopy(io.Discard, f)
+	return sum, err
 }
 
 func (s *SFTP) Exec(ctx context.Context, name string, args ...string) ([]byte, []byte, error) {
@@ -244,7 +304,8 @@ func (s *SFTP) Exec(ctx context.Context, name string, args ...string) ([]byte, [
 	}
 	defer sess.Close()
 
-	cmdLine := name
+	// The remote shell gets the program and each argument as one word.
+	cmdLine := shellQuote(name)
 	for _, a := range args {
 		cmdLine += " " + shellQuote(a)
 	}
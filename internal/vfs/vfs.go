@@ -19,13 +19,19 @@ type FS interface {
 	Rename(oldpath, newpath string) error
 	MkdirAll(path string, perm os.FileMode) error
 
-	// CopyToLocal downloads a remote file to a local path.
+	// CopyToLocal downloads a remote file to a local path and returns the
+	// hex SHA-256 of the data. Remote copies are verified against a hash
+	// taken where the file lives and retried on mismatch.
 	// For the local backend this is a plain file copy.
-	CopyToLocal(remotePath, localPath string) error
+	CopyToLocal(remotePath, localPath string) (sum string, err error)
 
-	// CopyFromLocal uploads a local file to a remote path.
+	// CopyFromLocal uploads a local file to a remote path, verified like
+	// CopyToLocal, and returns the hex SHA-256 of the data.
 	// For the local backend this is a plain file copy.
-	CopyFromLocal(localPath, remotePath string) error
+	CopyFromLocal(localPath, remotePath string) (sum string, err error)
+
+	// Hash returns the hex SHA-256 of a file, computed where it lives.
+	Hash(path string) (string, error)
 
 	// Exec runs a command (e.g. ffprobe) where the files live.
 	// For local, this is exec.CommandContext; for SFTP, ssh.Session.